@@ -0,0 +1,993 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// bridge holds the state shared between the alarm and MQTT sides.
+type bridge struct {
+	discoveryPrefix string
+	deviceID        string
+	device          deviceConfig
+
+	mqttClient mqtt.Client
+
+	// confirmTimeout is how long to wait for the alarm to confirm a command.
+	confirmTimeout time.Duration
+
+	// clearDelay is the delay between the two disarm sequences sent to
+	// clear the alarm memory.
+	clearDelay time.Duration
+
+	// commandDebounce is how long an identical command gets ignored for.
+	commandDebounce time.Duration
+
+	// armActions are the arming commands accepted from Home Assistant.
+	armActions []string
+
+	// armIgnoredTypes are the zone types which don't prevent arming when
+	// faulted, unless overridden by the zone configuration.
+	armIgnoredTypes []string
+
+	// exitDelayPatterns are matched against the keypad message to detect
+	// the exit delay.
+	exitDelayPatterns []string
+
+	// code is the code advertised to Home Assistant, REMOTE_CODE to have
+	// the user enter it.
+	code string
+
+	// codeLength is the expected length of the panel codes.
+	codeLength int
+
+	// codeArmRequired, codeDisarmRequired and codeTriggerRequired make
+	// the matching commands fail without a valid code.
+	codeArmRequired     bool
+	codeDisarmRequired  bool
+	codeTriggerRequired bool
+
+	// keyTemplates maps arming and disarming actions to the keys to send
+	// to the panel, overriding the panel's default sequence when set. The
+	// {code} placeholder gets replaced by the code.
+	keyTemplates map[string]string
+
+	// mode is the panel mode (Ademco or DSC) from the last keypad message,
+	// unless modeForced is set in which case it comes from the config.
+	mode       string
+	modeForced bool
+
+	// readOnly never writes to the AlarmDecoder, commands are ignored.
+	readOnly bool
+
+	// dryRun logs what would be written to the AlarmDecoder instead.
+	dryRun bool
+
+	// panelEnabled exposes the alarm panel entities, otherwise only the
+	// sensors are published.
+	panelEnabled bool
+
+	// panicKeys maps each panic action to the keys to send to the panel,
+	// only used when panicEnabled is set.
+	panicKeys    map[string]string
+	panicEnabled bool
+
+	// adLock protects ad and port which get replaced on reconnection.
+	adLock sync.Mutex
+	ad     *alarmdecoder.AlarmDecoder
+	port   io.ReadWriteCloser
+
+	// keyDelay is the delay between keypresses sent to the panel.
+	keyDelay time.Duration
+
+	// clock provides the time for zone timeouts, throttling and reconnections.
+	clock alarmdecoder.Clock
+
+	// lock protects the zones and everything tracking their state.
+	lock sync.Mutex
+
+	// mqttReady is set once the initial MQTT setup is done.
+	mqttReady bool
+
+	// watchdog fires when the panel stops sending messages, setting commLost.
+	watchdog        alarmdecoder.Timer
+	watchdogTimeout time.Duration
+	commLost        bool
+
+	// lastMessage is when the last valid message was received from the alarm.
+	lastMessage time.Time
+
+	// qos is the QoS of published messages and retain whether state
+	// messages get retained.
+	qos    byte
+	retain bool
+
+	// commandQoS is the QoS of the command subscriptions.
+	commandQoS byte
+
+	// removeOnShutdown clears all retained topics on shutdown.
+	removeOnShutdown bool
+
+	// filterDuplicates drops messages identical to the previous one, except
+	// once per duplicateInterval. lastUnparsed and lastUnparsedAt track the
+	// last message let through. They're only used by the read loop.
+	filterDuplicates  bool
+	duplicateInterval time.Duration
+	lastUnparsed      string
+	lastUnparsedAt    time.Time
+
+	// stale is set when publishing failed and everything needs to be
+	// republished. It's only used by the read loop.
+	stale bool
+
+	// lastKeypad is the last keypad message received from the alarm.
+	lastKeypad alarmdecoder.Message
+
+	// partitions are the alarm partitions, each with its own alarm panel entity.
+	partitions []*partition
+
+	zones     map[string]zone
+	zoneState map[string]bool
+
+	// autoDiscoverZones adds zones missing from the configuration when
+	// faulted, named after discoveryTemplate in which {zone} and {number}
+	// get replaced by the zone as reported and its number.
+	autoDiscoverZones bool
+	discoveryTemplate string
+	discoveryType     string
+
+	// entryDelayPatterns match the keypad messages shown during the entry
+	// delay, reported as pending.
+	entryDelayPatterns []string
+
+	// troublePatterns are the prefixes of keypad messages reporting a
+	// trouble rather than a zone fault.
+	troublePatterns []string
+
+	// troubleZones are the zones currently reporting a trouble.
+	troubleZones map[string]bool
+
+	// lastFaultedZone is the last panel zone reported as faulted.
+	lastFaultedZone string
+
+	// fireLatched is set from a fire alarm until the panel gets disarmed.
+	fireLatched bool
+
+	// faultCycle tracks the zones reported since the start of the current
+	// cycle through the faulted zones.
+	faultCycle map[string]bool
+
+	// throttle limits how often state topics get published.
+	throttle *throttle
+
+	// sensorState caches the last published state of the panel sensors by topic.
+	sensorState map[string]string
+
+	// zoneFaultedAt records when each zone was last reported as faulted.
+	zoneFaultedAt map[string]time.Time
+
+	// zoneAttributes publishes when each zone was last triggered, as
+	// recorded in zoneTriggeredAt by configuration key.
+	zoneAttributes  bool
+	zoneTriggeredAt map[string]time.Time
+
+	// refresh collects the faulted zones after a REFRESH_FAULTS command
+	// for refreshWindow.
+	refresh       *faultRefresh
+	refreshWindow time.Duration
+
+	// flapThreshold is how many state changes of a zone within flapWindow
+	// make it flapping, holding back its state. Zero disables it.
+	flapThreshold int
+	flapWindow    time.Duration
+	zoneFlips     map[string][]time.Time
+	flappingZones map[string]alarmdecoder.Timer
+
+	// metrics tracks the activity of the bridge.
+	metrics metrics
+
+	// publishParseErrors publishes the lines which failed to parse.
+	publishParseErrors bool
+
+	// stateFile is where the alarm and zone state is persisted, if set.
+	// stateTimer is the pending write, stateLock serializing the writes.
+	stateFile  string
+	stateTimer alarmdecoder.Timer
+	stateLock  sync.Mutex
+}
+
+// panelTopic returns the topic for the given suffix of the alarm panel entity.
+func (b *bridge) panelTopic(suffix string) string {
+	return fmt.Sprintf("%s/alarm_control_panel/%s/%s", b.discoveryPrefix, b.deviceID, suffix)
+}
+
+// zoneTopic returns the topic for the given suffix of a zone entity.
+func (b *bridge) zoneTopic(z zone, suffix string) string {
+	if z.isTrigger() {
+		return fmt.Sprintf("%s/device_automation/%s/%s", b.discoveryPrefix, z.Name, suffix)
+	}
+
+	return fmt.Sprintf("%s/binary_sensor/%s/%s", b.discoveryPrefix, z.Name, suffix)
+}
+
+// availabilityTopic returns the topic used to report whether the bridge is running.
+func (b *bridge) availabilityTopic() string {
+	return b.panelTopic("availability")
+}
+
+// publish sends a state message and waits for it to be acknowledged. State
+// messages are retained unless configured otherwise.
+func (b *bridge) publish(topic string, payload string) error {
+	return b.publishMessage(topic, b.retain, payload)
+}
+
+// publishRetained sends a retained message, as used for the discovery
+// configuration and availability, and waits for it to be acknowledged.
+func (b *bridge) publishRetained(topic string, payload string) error {
+	return b.publishMessage(topic, true, payload)
+}
+
+// publishMessage sends a message at the configured QoS and waits for it to
+// be acknowledged.
+func (b *bridge) publishMessage(topic string, retained bool, payload string) error {
+	if token := b.mqttClient.Publish(topic, b.qos, retained, payload); token.Wait() && token.Error() != nil {
+		b.metrics.publishFailed()
+		return token.Error()
+	}
+
+	return nil
+}
+
+// publishJSON publishes a retained JSON encoded message.
+func (b *bridge) publishJSON(topic string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return b.publishRetained(topic, string(data))
+}
+
+// publishConfig publishes the Home Assistant discovery configuration for the
+// alarm panels and all enabled zones. The caller must hold the lock.
+func (b *bridge) publishConfig() error {
+	for _, p := range b.partitions {
+		var err error
+		if b.panelEnabled {
+			err = b.publishJSON(b.partitionTopic(p, "config"), b.panelConfig(p))
+		} else {
+			// Remove any alarm panel published before it got disabled.
+			err = b.publishRetained(b.partitionTopic(p, "config"), "")
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err := b.publishSensorConfig()
+	if err != nil {
+		return err
+	}
+
+	for _, zone := range b.zones {
+		if zone.Disabled || zone.Name == "" {
+			continue
+		}
+
+		err := b.publishZoneConfig(zone)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publishZoneConfig publishes the Home Assistant discovery configuration for a zone.
+func (b *bridge) publishZoneConfig(zone zone) error {
+	if zone.isTrigger() {
+		return b.publishJSON(b.zoneTopic(zone, "config"), b.zoneTriggerConfig(zone))
+	}
+
+	return b.publishJSON(b.zoneTopic(zone, "config"), b.zoneConfig(zone))
+}
+
+// publishZoneState publishes the current state of a zone. Trigger zones
+// don't have a state, only events.
+func (b *bridge) publishZoneState(k string, zone zone) error {
+	if zone.isTrigger() {
+		return nil
+	}
+
+	err := b.publish(b.zoneTopic(zone, "state"), zone.payload(zoneFaulted(k, zone, b.zoneState)))
+	if err != nil {
+		return err
+	}
+
+	_, ok := b.zoneTriggeredAt[k]
+	if !b.zoneAttributes || !ok {
+		return nil
+	}
+
+	return b.publishZoneAttributes(k, zone)
+}
+
+// zoneAttributesPayload holds the attributes of a zone entity.
+type zoneAttributesPayload struct {
+	LastTriggered string `json:"last_triggered"`
+}
+
+// publishZoneAttributes publishes when the zone was last triggered.
+func (b *bridge) publishZoneAttributes(k string, zone zone) error {
+	data, err := json.Marshal(zoneAttributesPayload{
+		LastTriggered: b.zoneTriggeredAt[k].Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.publish(b.zoneTopic(zone, "attributes"), string(data))
+}
+
+// publishState publishes the current alarm state of all partitions and the
+// state of all enabled zones. The caller must hold the lock.
+func (b *bridge) publishState() error {
+	for _, p := range b.partitions {
+		if !b.panelEnabled || p.alarmState == "" {
+			continue
+		}
+
+		err := b.publish(b.partitionTopic(p, "state"), p.alarmState)
+		if err != nil {
+			return err
+		}
+
+		if p.attributes != "" {
+			err := b.publish(b.partitionTopic(p, "attributes"), p.attributes)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := b.publishSensorState()
+	if err != nil {
+		return err
+	}
+
+	for k, zone := range b.zones {
+		if zone.Disabled || zone.Name == "" {
+			continue
+		}
+
+		err := b.publishZoneState(k, zone)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// republish publishes the discovery configuration and current state of all
+// entities.
+func (b *bridge) republish() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	err := b.publishConfig()
+	if err != nil {
+		return err
+	}
+
+	return b.publishState()
+}
+
+// shutdown flushes the current state, marks the bridge as offline and
+// disconnects from MQTT.
+func (b *bridge) shutdown() error {
+	b.flushState()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.watchdog != nil {
+		b.watchdog.Stop()
+	}
+
+	var err error
+	if b.removeOnShutdown {
+		err = b.removeEntities()
+	} else {
+		err = b.publishState()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = b.publishRetained(b.availabilityTopic(), "offline")
+	if err != nil {
+		return err
+	}
+
+	b.mqttClient.Disconnect(250)
+
+	return nil
+}
+
+// zoneQueryTopic returns the topic on which zone names can be published to
+// have their state republished.
+func (b *bridge) zoneQueryTopic() string {
+	return b.sensorTopic("binary_sensor", "zone", "query")
+}
+
+// handleZoneQuery republishes the current state of the zone with the given name.
+func (b *bridge) handleZoneQuery(name string) {
+	name = strings.TrimSpace(name)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for k, zone := range b.zones {
+		if zone.Disabled || zone.Name != name {
+			continue
+		}
+
+		err := b.publishZoneState(k, zone)
+		if err != nil {
+			logErrorf("[mqtt] Failed to publish the state of zone %q: %v", name, err)
+		}
+
+		return
+	}
+
+	logWarnf("[mqtt] Received a query for unknown zone %q", name)
+}
+
+// removeEntities clears the retained discovery configuration and state of
+// all entities so Home Assistant removes them. The caller must hold the lock.
+func (b *bridge) removeEntities() error {
+	topics := []string{b.panelTopic("debug")}
+	for _, p := range b.partitions {
+		topics = append(topics, b.partitionTopic(p, "config"), b.partitionTopic(p, "state"), b.partitionTopic(p, "attributes"))
+	}
+
+	for _, sensor := range append(binarySensors, latchedSensors...) {
+		topics = append(topics, b.sensorTopic("binary_sensor", sensor.id, "config"), b.sensorTopic("binary_sensor", sensor.id, "state"))
+	}
+
+	for _, sensor := range append(sensors, trackedSensors...) {
+		topics = append(topics, b.sensorTopic("sensor", sensor.id, "config"), b.sensorTopic("sensor", sensor.id, "state"))
+	}
+
+	for _, zone := range b.zones {
+		if zone.Disabled || zone.Name == "" {
+			continue
+		}
+
+		topics = append(topics, b.zoneTopic(zone, "config"), b.zoneTopic(zone, "state"), b.zoneTopic(zone, "attributes"))
+	}
+
+	for _, topic := range topics {
+		err := b.publishRetained(topic, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	logInfof("[mqtt] Removed all entities")
+
+	return nil
+}
+
+// lookupZone returns the configuration key and zone reporting a panel zone,
+// either directly or as one of its source zones.
+func (b *bridge) lookupZone(k string) (string, zone, bool) {
+	z, ok := b.zones[k]
+	if ok {
+		return k, z, true
+	}
+
+	for owner, z := range b.zones {
+		if stringInSlice(k, z.SourceZones) {
+			return owner, z, true
+		}
+	}
+
+	return "", zone{}, false
+}
+
+// zoneFaulted returns whether the zone or any of its source zones is faulted.
+func zoneFaulted(k string, z zone, zoneState map[string]bool) bool {
+	if zoneState[k] {
+		return true
+	}
+
+	for _, source := range z.SourceZones {
+		if zoneState[source] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// armingBlocked returns the name of a faulted zone preventing arming, the
+// caller must hold the lock. Faulted zones which aren't configured always
+// prevent arming.
+func (b *bridge) armingBlocked() (string, bool) {
+	keys := []string{}
+	for k, faulted := range b.zoneState {
+		if faulted {
+			keys = append(keys, k)
+		}
+	}
+
+	// The panel reports a fault without any known zone.
+	if len(keys) == 0 {
+		return "", true
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, zone, ok := b.lookupZone(k)
+		if !ok {
+			return fmt.Sprintf("Zone %s", k), true
+		}
+
+		if !zone.blocksArming(b.armIgnoredTypes) {
+			continue
+		}
+
+		if zone.FriendlyName != "" {
+			return zone.FriendlyName, true
+		}
+
+		return zone.Name, true
+	}
+
+	return "", false
+}
+
+// setZoneState updates the state of a panel zone, publishing the state of the
+// zone reporting it if it changed.
+func (b *bridge) setZoneState(k string, state bool) error {
+	if state {
+		b.lastFaultedZone = k
+	}
+
+	if state == b.zoneState[k] {
+		return nil
+	}
+
+	owner, zone, _ := b.lookupZone(k)
+	wasFaulted := zoneFaulted(owner, zone, b.zoneState)
+
+	b.zoneState[k] = state
+	b.saveState()
+
+	faulted := zoneFaulted(owner, zone, b.zoneState)
+	if zone.Name == "" || faulted == wasFaulted {
+		return nil
+	}
+
+	flapping, err := b.zoneFlapping(owner, zone)
+	if err != nil || flapping {
+		return err
+	}
+
+	if zone.isTrigger() && faulted {
+		// Trigger events are momentary so never retained nor throttled.
+		err = b.publishMessage(b.zoneTopic(zone, "trigger"), false, zone.payloadOn())
+	} else if !zone.isTrigger() {
+		err = b.publishThrottled(b.zoneTopic(zone, "state"), zone.payload(faulted))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if faulted && b.zoneAttributes && !zone.isTrigger() {
+		b.zoneTriggeredAt[owner] = b.clock.Now()
+
+		err := b.publishZoneAttributes(owner, zone)
+		if err != nil {
+			return err
+		}
+	}
+
+	if faulted {
+		logInfof("[alarm] Zone %q has been triggered", zone.Name)
+	} else {
+		logInfof("[alarm] Zone %q has been cleared", zone.Name)
+	}
+
+	return nil
+}
+
+// clearZones clears all triggered keypad zones except those for which keep
+// returns true.
+func (b *bridge) clearZones(keep func(k string) bool) error {
+	for k, v := range b.zoneState {
+		if !v || keep(k) {
+			continue
+		}
+
+		_, zone, _ := b.lookupZone(k)
+		if zone.isExternal() {
+			continue
+		}
+
+		err := b.setZoneState(k, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// zoneTimedOut returns whether the zone has a clear timeout configured and
+// hasn't been reported as faulted within it.
+func (b *bridge) zoneTimedOut(k string, now time.Time) bool {
+	_, zone, _ := b.lookupZone(k)
+	timeout := time.Duration(zone.ClearTimeout) * time.Second
+	if timeout <= 0 {
+		return false
+	}
+
+	return now.Sub(b.zoneFaultedAt[k]) >= timeout
+}
+
+// alarmStateFor returns the Home Assistant alarm state matching a keypad message.
+func (b *bridge) alarmStateFor(msg alarmdecoder.Message) string {
+	if msg.AlarmSounding || msg.AlarmHasOccured {
+		return "triggered"
+	} else if (msg.ArmedHome || msg.ArmedAway) && matchesPattern(msg.NormalizedKeypadMessage(), b.exitDelayPatterns) {
+		return "arming"
+	} else if matchesPattern(msg.NormalizedKeypadMessage(), b.entryDelayPatterns) {
+		return "pending"
+	} else if msg.ArmedHome && msg.PerimeterOnly && msg.EntryDelayDisabled {
+		return "armed_night"
+	} else if msg.ArmedHome {
+		return "armed_home"
+	} else if msg.ArmedAway {
+		return "armed_away"
+	}
+
+	return "disarmed"
+}
+
+// matchesPrefix returns whether the keypad text starts with any of the
+// prefixes, ignoring case.
+func matchesPrefix(text string, prefixes []string) bool {
+	text = strings.ToUpper(text)
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(text, strings.ToUpper(prefix)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesPattern returns whether the keypad text contains any of the
+// patterns, ignoring case and differences in whitespace.
+func matchesPattern(text string, patterns []string) bool {
+	text = strings.ToUpper(text)
+	for _, pattern := range patterns {
+		pattern = strings.Join(strings.Fields(pattern), " ")
+		if strings.Contains(text, strings.ToUpper(pattern)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleMessage processes a message received from the alarm.
+func (b *bridge) handleMessage(msg alarmdecoder.Message) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.lastMessage = b.clock.Now()
+
+	err := b.feedWatchdog()
+	if err != nil {
+		return err
+	}
+
+	switch msg.Type() {
+	case alarmdecoder.EventLRR, alarmdecoder.EventRelay:
+		// Long Range Radio events and relay modules don't map to any entity.
+		logInfof("[alarm] %s", msg)
+		return nil
+	case alarmdecoder.EventVersion:
+		logInfof("[alarm] %s", msg)
+		return nil
+	case alarmdecoder.EventAUI:
+		// AUI messages aren't decoded yet.
+		logDebugf("[alarm] %s", msg)
+		return nil
+	case alarmdecoder.EventRFX:
+		return b.handleRFX(msg)
+	case alarmdecoder.EventExpander:
+		return b.handleExpander(msg)
+	}
+
+	return b.handleKeypad(msg)
+}
+
+// processMessage handles a message from the read loop. Publish failures get
+// logged rather than stopping the bridge and everything gets republished
+// once publishing works again.
+func (b *bridge) processMessage(msg alarmdecoder.Message) {
+	if b.isDuplicate(msg) {
+		return
+	}
+
+	err := b.handleMessage(msg)
+	if err != nil {
+		logErrorf("[mqtt] Failed to publish the alarm state: %v", err)
+		b.stale = true
+		return
+	}
+
+	if !b.stale {
+		return
+	}
+
+	err = b.republish()
+	if err != nil {
+		logErrorf("[mqtt] Failed to republish the alarm state: %v", err)
+		return
+	}
+
+	logInfof("[mqtt] Republished the alarm state after publish failures")
+	b.stale = false
+}
+
+// isDuplicate returns whether the message repeats the previous one and should
+// be dropped. Repeated messages still go through once per duplicateInterval
+// so the watchdog keeps seeing the panel. It's only used by the read loop.
+func (b *bridge) isDuplicate(msg alarmdecoder.Message) bool {
+	if !b.filterDuplicates {
+		return false
+	}
+
+	now := b.clock.Now()
+	if msg.UnparsedMessage == b.lastUnparsed && now.Sub(b.lastUnparsedAt) < b.duplicateInterval {
+		return true
+	}
+
+	b.lastUnparsed = msg.UnparsedMessage
+	b.lastUnparsedAt = now
+
+	return false
+}
+
+// handleRFX processes a wireless sensor message, mapped to zones by serial
+// number and loop.
+func (b *bridge) handleRFX(msg alarmdecoder.Message) error {
+	for k, zone := range b.zones {
+		if zone.Disabled || zone.Name == "" || zone.RFSerial != msg.RFX.SerialNumber {
+			continue
+		}
+
+		loop := zone.RFLoop
+		if loop == 0 {
+			loop = 1
+		}
+
+		err := b.setZoneState(k, msg.RFX.Loop(loop))
+		if err != nil {
+			return err
+		}
+	}
+
+	if msg.RFX.LowBattery {
+		logWarnf("[alarm] Wireless sensor %q has a low battery", msg.RFX.SerialNumber)
+	}
+
+	return nil
+}
+
+// handleExpander processes a zone expander message, mapped to zones by
+// address and channel.
+func (b *bridge) handleExpander(msg alarmdecoder.Message) error {
+	for k, zone := range b.zones {
+		if zone.Disabled || zone.Name == "" || zone.ExpanderAddress != msg.Expander.Address || zone.ExpanderChannel != msg.Expander.Channel {
+			continue
+		}
+
+		err := b.setZoneState(k, msg.Expander.State)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// discoverZone adds a zone which isn't in the configuration, publishing it
+// as a generic binary sensor. The caller must hold the lock.
+func (b *bridge) discoverZone(k string, number int) (zone, error) {
+	// Never replace a configured zone.
+	existing, ok := b.zones[k]
+	if ok {
+		return existing, nil
+	}
+
+	name := strings.ReplaceAll(b.discoveryTemplate, "{zone}", k)
+	name = strings.ReplaceAll(name, "{number}", strconv.Itoa(number))
+
+	newZone := zone{
+		Name:         fmt.Sprintf("%s_zone_%s", b.deviceID, k),
+		FriendlyName: name,
+		Type:         b.discoveryType,
+		discovered:   true,
+	}
+
+	err := b.publishZoneConfig(newZone)
+	if err != nil {
+		return zone{}, err
+	}
+
+	if b.zones == nil {
+		b.zones = map[string]zone{}
+	}
+
+	b.zones[k] = newZone
+	logInfof("[alarm] Discovered zone %q", newZone.Name)
+
+	return newZone, nil
+}
+
+// handleKeypad processes a keypad message.
+func (b *bridge) handleKeypad(msg alarmdecoder.Message) error {
+	prev := b.lastKeypad
+	b.lastKeypad = msg
+
+	if !b.modeForced && msg.Mode != "" && msg.Mode != b.mode {
+		b.mode = msg.Mode
+		logInfof("[alarm] Detected panel mode %s", b.mode)
+	}
+
+	// Update the alarm state of the partitions the message is intended for.
+	for _, p := range b.partitions {
+		if !b.panelEnabled || !p.matches(msg) {
+			continue
+		}
+
+		p.faulted = msg.Type() == alarmdecoder.EventFault
+
+		state := b.alarmStateFor(msg)
+		err := b.updateLastAlarmZone(msg, p.alarmState, state)
+		if err != nil {
+			return err
+		}
+
+		err = b.setAlarmState(p, state)
+		if err != nil {
+			return err
+		}
+
+		b.confirmState(p, state)
+
+		err = b.setAttributes(p, msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Update the panel sensors.
+	err := b.updateSensors(msg)
+	if err != nil {
+		return err
+	}
+
+	err = b.updateFire(prev, msg)
+	if err != nil {
+		return err
+	}
+
+	// Troubles such as tampers or supervision failures get reported
+	// separately from zone faults.
+	trouble := !msg.Ready && matchesPrefix(msg.NormalizedKeypadMessage(), b.troublePatterns)
+	if trouble && !b.troubleZones[msg.Zone] {
+		b.troubleZones[msg.Zone] = true
+		logWarnf("[alarm] Trouble on zone %q: %s", msg.Zone, msg.NormalizedKeypadMessage())
+	}
+
+	// Handle zone triggers.
+	_, zone, ok := b.lookupZone(msg.Zone)
+	if trouble {
+		ok = false
+	} else if !ok && !msg.Ready && msg.Zone != "" {
+		// Zone 000 and zone bus failures don't match an actual zone.
+		number, numberErr := msg.ZoneNumber()
+		if b.autoDiscoverZones && numberErr == nil && number > 0 && !msg.ZoneBusFailure {
+			zone, err = b.discoverZone(msg.Zone, number)
+			if err != nil {
+				return err
+			}
+
+			ok = true
+		} else {
+			logWarnf("[alarm] Unknown zone %q has been triggered", msg.Zone)
+		}
+	}
+
+	if b.refresh != nil && !trouble && !msg.Ready && msg.Zone != "" {
+		b.refresh.seen[msg.Zone] = true
+	}
+
+	now := b.clock.Now()
+	if ok && !zone.Disabled && !zone.isExternal() {
+		if !msg.Ready {
+			b.zoneFaultedAt[msg.Zone] = now
+		}
+
+		if !msg.Ready || !b.zoneTimedOut(msg.Zone, now) {
+			err := b.setZoneState(msg.Zone, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// When multiple zones are faulted, the panel cycles through them one
+	// message at a time. Seeing a zone twice means a full cycle went by so
+	// any zone which wasn't reported during it has been cleared.
+	if !msg.Ready {
+		if b.faultCycle[msg.Zone] {
+			err := b.clearZones(func(k string) bool { return b.faultCycle[k] })
+			if err != nil {
+				return err
+			}
+
+			for k := range b.troubleZones {
+				if !b.faultCycle[k] {
+					delete(b.troubleZones, k)
+				}
+			}
+
+			b.faultCycle = map[string]bool{}
+		}
+
+		b.faultCycle[msg.Zone] = true
+		return b.updateTrouble()
+	}
+
+	// Once things are quiet, clear any formerly triggered zone.
+	b.faultCycle = map[string]bool{}
+	b.troubleZones = map[string]bool{}
+	err = b.clearZones(func(k string) bool { return k == msg.Zone && !b.zoneTimedOut(k, now) })
+	if err != nil {
+		return err
+	}
+
+	return b.updateTrouble()
+}
+
+// updateTrouble publishes whether any trouble is currently reported.
+func (b *bridge) updateTrouble() error {
+	value := "off"
+	if len(b.troubleZones) > 0 {
+		value = "on"
+	}
+
+	return b.setSensorState("binary_sensor", troubleSensor.id, value)
+}
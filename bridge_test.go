@@ -0,0 +1,924 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+type dummyClient struct {
+	mqtt.Client
+
+	lock      sync.Mutex
+	published map[string]string
+	count     map[string]int
+	retained  map[string]bool
+	qos       map[string]byte
+
+	subscribed []string
+}
+
+func (c *dummyClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.published[topic] = payload.(string)
+	c.count[topic]++
+	c.retained[topic] = retained
+	c.qos[topic] = qos
+	return &mqtt.DummyToken{}
+}
+
+func (c *dummyClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.subscribed = append(c.subscribed, topic)
+	return &mqtt.DummyToken{}
+}
+
+func (c *dummyClient) IsConnected() bool {
+	return true
+}
+
+func (c *dummyClient) Disconnect(quiesce uint) {}
+
+func (c *dummyClient) get(topic string) (string, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.published[topic], c.count[topic]
+}
+
+// fakeClock is a Clock which only moves forward when told to. Channels from
+// After fire immediately while AfterFunc timers fire on Advance.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.Now().Add(d)
+	return ch
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) alarmdecoder.Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward, calling the functions of the timers
+// which expire along the way in order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if t.active && !t.at.After(end) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		next.active = false
+		c.now = next.at
+
+		// The function may use the clock itself.
+		c.lock.Unlock()
+		next.f()
+		c.lock.Lock()
+	}
+
+	c.now = end
+	c.lock.Unlock()
+}
+
+// Pending returns the number of timers which haven't fired or been stopped.
+func (c *fakeClock) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	count := 0
+	for _, t := range c.timers {
+		if t.active {
+			count++
+		}
+	}
+
+	return count
+}
+
+// fakeTimer is a timer of the fakeClock.
+type fakeTimer struct {
+	clock  *fakeClock
+	at     time.Time
+	f      func()
+	active bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	active := t.active
+	t.active = true
+	t.at = t.clock.now.Add(d)
+	return active
+}
+
+func newTestBridge(zones map[string]zone) (*bridge, *dummyClient) {
+	client := &dummyClient{published: map[string]string{}, count: map[string]int{}, retained: map[string]bool{}, qos: map[string]byte{}}
+
+	return &bridge{
+		discoveryPrefix: "homeassistant",
+		deviceID:        "ad2mqtt",
+
+		clock:        alarmdecoder.RealClock,
+		zones:        zones,
+		partitions:   []*partition{{}},
+		panelEnabled: true,
+		retain:       true,
+		mqttClient:   client,
+
+		codeDisarmRequired: true,
+
+		armActions:         []string{"ARM_HOME", "ARM_AWAY", "ARM_NIGHT"},
+		armIgnoredTypes:    []string{"motion", "occupancy", "presence"},
+		exitDelayPatterns:  []string{"EXIT NOW", "EXIT DELAY"},
+		entryDelayPatterns: []string{"DISARM SYSTEM", "ENTRY DELAY"},
+		troublePatterns:    []string{"CHECK", "TRBL"},
+		troubleZones:       map[string]bool{},
+		discoveryTemplate:  "Zone {zone}",
+
+		throttle:      newThrottle(0),
+		zoneState:     map[string]bool{},
+		faultCycle:    map[string]bool{},
+		sensorState:   map[string]string{},
+		zoneFaultedAt: map[string]time.Time{},
+
+		zoneTriggeredAt: map[string]time.Time{},
+		zoneFlips:       map[string][]time.Time{},
+		flappingZones:   map[string]alarmdecoder.Timer{},
+	}, client
+}
+
+func TestClearTimeout(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{
+		"005": {Name: "door", ClearTimeout: 60},
+		"006": {Name: "window"},
+	})
+
+	clock := &fakeClock{now: time.Now()}
+	b.clock = clock
+
+	zoneState := func(name string) string {
+		return client.published["homeassistant/binary_sensor/"+name+"/state"]
+	}
+
+	// Both zones get faulted.
+	for _, z := range []string{"005", "006"} {
+		err := b.handleMessage(alarmdecoder.Message{Zone: z})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if zoneState("door") != "on" || zoneState("window") != "on" {
+		t.Fatalf("expected both zones to be on, got %q and %q", zoneState("door"), zoneState("window"))
+	}
+
+	// The panel keeps reporting the last zones while ready.
+	err := b.handleMessage(alarmdecoder.Message{Ready: true, Zone: "005"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if zoneState("door") != "on" {
+		t.Errorf("expected door to still be on within its timeout, got %q", zoneState("door"))
+	}
+
+	if zoneState("window") != "off" {
+		t.Errorf("expected window to be cleared, got %q", zoneState("window"))
+	}
+
+	// Once the timeout expires, the zone gets cleared even if still reported.
+	clock.Advance(time.Minute)
+	err = b.handleMessage(alarmdecoder.Message{Ready: true, Zone: "005"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if zoneState("door") != "off" {
+		t.Errorf("expected door to be cleared after its timeout, got %q", zoneState("door"))
+	}
+
+	// Without a timeout, the zone remains triggered.
+	err = b.handleMessage(alarmdecoder.Message{Zone: "006"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	err = b.handleMessage(alarmdecoder.Message{Ready: true, Zone: "006"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if zoneState("window") != "on" {
+		t.Errorf("expected window without timeout to still be on, got %q", zoneState("window"))
+	}
+}
+
+func TestFaultCycle(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{
+		"005": {Name: "door"},
+		"006": {Name: "window"},
+		"007": {Name: "garage"},
+	})
+
+	fault := func(zones ...string) {
+		t.Helper()
+
+		for _, z := range zones {
+			err := b.handleMessage(alarmdecoder.Message{Zone: z, KeypadMessage: "FAULT " + z, UnparsedMessage: "test"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	check := func(name string, want string, wantCount int) {
+		t.Helper()
+
+		value, count := client.get("homeassistant/binary_sensor/" + name + "/state")
+		if value != want || count != wantCount {
+			t.Errorf("got %s state %q after %d publishes; wanted %q after %d", name, value, count, want, wantCount)
+		}
+	}
+
+	// The keypad rotates through the three open zones, none of them flips
+	// off while they keep being reported.
+	fault("005", "006", "007", "005", "006", "007", "005")
+	check("door", "on", 1)
+	check("window", "on", 1)
+	check("garage", "on", 1)
+
+	// The garage gets closed, it's cleared once a full cycle went by
+	// without it.
+	fault("006")
+	check("garage", "on", 1)
+
+	fault("005")
+	check("door", "on", 1)
+	check("window", "on", 1)
+	check("garage", "off", 2)
+
+	// Once ready, all zones get cleared.
+	err := b.handleMessage(alarmdecoder.Message{Ready: true, KeypadMessage: "READY", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check("door", "off", 2)
+	check("window", "off", 2)
+	check("garage", "off", 2)
+}
+
+func TestAlarmStateFor(t *testing.T) {
+	b, _ := newTestBridge(nil)
+
+	cases := []struct {
+		msg  alarmdecoder.Message
+		want string
+	}{
+		{alarmdecoder.Message{Ready: true, KeypadMessage: "****DISARMED****  READY TO ARM"}, "disarmed"},
+		{alarmdecoder.Message{KeypadMessage: "FAULT 05 FRONT DOOR"}, "disarmed"},
+		{alarmdecoder.Message{ArmedAway: true, KeypadMessage: "DISARM SYSTEM   Or alarm occurs"}, "pending"},
+		{alarmdecoder.Message{ArmedAway: true, KeypadMessage: "ARMED ***AWAY***May Exit Now  15"}, "arming"},
+		{alarmdecoder.Message{ArmedAway: true, KeypadMessage: "ARMED ***AWAY***ALL SECURE **"}, "armed_away"},
+		{alarmdecoder.Message{ArmedAway: true, KeypadMessage: "ARMED ***AWAY***  EXIT   NOW  15"}, "arming"},
+		{alarmdecoder.Message{ArmedHome: true, KeypadMessage: "ARMED ***STAY***May Exit Now  30"}, "arming"},
+		{alarmdecoder.Message{ArmedHome: true, KeypadMessage: "ARMED ***STAY***"}, "armed_home"},
+		{alarmdecoder.Message{ArmedHome: true, PerimeterOnly: true, EntryDelayDisabled: true, KeypadMessage: "ARMED *INSTANT*"}, "armed_night"},
+		{alarmdecoder.Message{ArmedAway: true, AlarmSounding: true}, "triggered"},
+	}
+
+	for i, c := range cases {
+		out := b.alarmStateFor(c.msg)
+		if out != c.want {
+			t.Errorf("%d. alarmStateFor(%q) = %q; not %q", i, c.msg.KeypadMessage, out, c.want)
+		}
+	}
+}
+
+func TestUnknownZone(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{})
+
+	err := b.handleMessage(alarmdecoder.Message{Zone: "009", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.zoneState["009"] {
+		t.Errorf("expected unknown zone to be ignored")
+	}
+
+	// With auto-discovery, the zone gets published.
+	b.autoDiscoverZones = true
+	err = b.handleMessage(alarmdecoder.Message{Zone: "009", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := client.get("homeassistant/binary_sensor/ad2mqtt_zone_009/config"); value == "" {
+		t.Errorf("expected discovered zone config to be published")
+	}
+
+	if value, _ := client.get("homeassistant/binary_sensor/ad2mqtt_zone_009/state"); value != "on" {
+		t.Errorf("got discovered zone state %q; wanted %q", value, "on")
+	}
+
+	// The name and type come from the configuration.
+	b.discoveryTemplate = "Sensor {number}"
+	b.discoveryType = "window"
+	err = b.handleMessage(alarmdecoder.Message{Zone: "012", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if zone := b.zones["012"]; zone.FriendlyName != "Sensor 12" || zone.Type != "window" {
+		t.Errorf("got discovered zone %+v", zone)
+	}
+
+	// Zone 000 and zone bus failures don't get discovered.
+	for _, msg := range []alarmdecoder.Message{
+		{Zone: "000", UnparsedMessage: "test"},
+		{Zone: "0af", ZoneBusFailure: true, UnparsedMessage: "test"},
+	} {
+		err = b.handleMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := b.zones[msg.Zone]; ok {
+			t.Errorf("expected zone %q not to be discovered", msg.Zone)
+		}
+	}
+}
+
+func TestTrouble(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{"002": {Name: "door"}})
+
+	err := b.handleMessage(alarmdecoder.Message{Zone: "002", KeypadMessage: "CHECK 02  FRONT DOOR", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := client.get("homeassistant/binary_sensor/ad2mqtt/trouble/state"); value != "on" {
+		t.Errorf("got trouble state %q; wanted %q", value, "on")
+	}
+
+	if b.zoneState["002"] {
+		t.Errorf("expected trouble to leave the zone untouched")
+	}
+
+	// Troubles are cleared once the panel is ready.
+	err = b.handleMessage(alarmdecoder.Message{Ready: true, KeypadMessage: "READY", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := client.get("homeassistant/binary_sensor/ad2mqtt/trouble/state"); value != "off" {
+		t.Errorf("got trouble state %q; wanted %q", value, "off")
+	}
+}
+
+func TestInvertedZone(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{
+		"007": {Name: "window", Inverted: true, PayloadOn: "OPEN", PayloadOff: "CLOSED"},
+	})
+
+	// A faulted normally closed sensor reports the off payload.
+	err := b.setZoneState("007", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := client.get("homeassistant/binary_sensor/window/state"); value != "CLOSED" {
+		t.Errorf("got faulted state %q; wanted %q", value, "CLOSED")
+	}
+
+	err = b.setZoneState("007", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := client.get("homeassistant/binary_sensor/window/state"); value != "OPEN" {
+		t.Errorf("got cleared state %q; wanted %q", value, "OPEN")
+	}
+
+	config := b.zoneConfig(b.zones["007"])
+	if config.PayloadOn != "OPEN" || config.PayloadOff != "CLOSED" {
+		t.Errorf("got payloads %q/%q; wanted %q/%q", config.PayloadOn, config.PayloadOff, "OPEN", "CLOSED")
+	}
+}
+
+func TestTriggerZone(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{
+		"009": {Name: "doorbell", FriendlyName: "Doorbell", Mode: "trigger"},
+	})
+
+	err := b.publishConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := client.get("homeassistant/device_automation/doorbell/config")
+
+	var config deviceTriggerConfig
+	err = json.Unmarshal([]byte(data), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.AutomationType != "trigger" || config.Topic != "homeassistant/device_automation/doorbell/trigger" || config.Subtype != "Doorbell" {
+		t.Errorf("got config %+v", config)
+	}
+
+	// Faults publish a momentary event, clearing doesn't.
+	for _, state := range []bool{true, false, true} {
+		err = b.setZoneState("009", state)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value, count := client.get(config.Topic)
+	if value != "on" || count != 2 || client.retained[config.Topic] {
+		t.Errorf("got %d events %q (retained %v)", count, value, client.retained[config.Topic])
+	}
+
+	if _, count := client.get("homeassistant/binary_sensor/doorbell/state"); count != 0 {
+		t.Errorf("expected no binary sensor state, got %d publishes", count)
+	}
+}
+
+func TestZoneAttributes(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{"005": {Name: "door"}})
+	b.zoneAttributes = true
+
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	b.clock = &fakeClock{now: now}
+
+	topic := "homeassistant/binary_sensor/door/attributes"
+	if b.zoneConfig(b.zones["005"]).JSONAttributesTopic != topic {
+		t.Errorf("got attributes topic %q", b.zoneConfig(b.zones["005"]).JSONAttributesTopic)
+	}
+
+	// Only faulting the zone updates the timestamp.
+	for _, state := range []bool{true, false} {
+		err := b.setZoneState("005", state)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value, count := client.get(topic)
+	if value != `{"last_triggered":"2021-06-01T12:00:00Z"}` || count != 1 {
+		t.Errorf("got attributes %q after %d publishes", value, count)
+	}
+}
+
+func TestFlappingZone(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{"007": {Name: "window"}})
+	b.flapThreshold = 3
+	b.flapWindow = time.Minute
+
+	clock := &fakeClock{now: time.Now()}
+	b.clock = clock
+
+	topic := "homeassistant/binary_sensor/window/state"
+
+	// Only the changes up to the threshold get published.
+	b.lock.Lock()
+	for _, state := range []bool{true, false, true, false, true, false} {
+		err := b.setZoneState("007", state)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.lock.Unlock()
+
+	if value, count := client.get(topic); value != "on" || count != 3 {
+		t.Errorf("got state %q after %d publishes; wanted %q after %d", value, count, "on", 3)
+	}
+
+	if value, _ := client.get("homeassistant/sensor/ad2mqtt/flapping_zones/state"); value != "window" {
+		t.Errorf("got flapping zones %q; wanted %q", value, "window")
+	}
+
+	// Each change while flapping restarts the window.
+	clock.Advance(30 * time.Second)
+
+	b.lock.Lock()
+	for _, state := range []bool{true, false} {
+		err := b.setZoneState("007", state)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.lock.Unlock()
+
+	clock.Advance(45 * time.Second)
+	if value, count := client.get(topic); value != "on" || count != 3 {
+		t.Errorf("got state %q after %d publishes; wanted %q after %d", value, count, "on", 3)
+	}
+
+	// Once settled, the current state gets published.
+	clock.Advance(15 * time.Second)
+
+	if value, count := client.get(topic); value != "off" || count != 4 {
+		t.Errorf("got state %q after %d publishes; wanted %q after %d", value, count, "off", 4)
+	}
+
+	if value, _ := client.get("homeassistant/sensor/ad2mqtt/flapping_zones/state"); value != "" {
+		t.Errorf("got flapping zones %q; wanted none", value)
+	}
+}
+
+func TestSourceZones(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{
+		"001": {Name: "front_door", SourceZones: []string{"002"}},
+	})
+
+	zoneState := func() string {
+		value, _ := client.get("homeassistant/binary_sensor/front_door/state")
+		return value
+	}
+
+	// Both contacts get faulted.
+	for _, z := range []string{"001", "002"} {
+		err := b.handleMessage(alarmdecoder.Message{Zone: z, UnparsedMessage: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if zoneState() != "on" {
+		t.Fatalf("got state %q; wanted %q", zoneState(), "on")
+	}
+
+	// Only the second contact is still reported, the sensor stays on.
+	for _, z := range []string{"002", "002"} {
+		err := b.handleMessage(alarmdecoder.Message{Zone: z, UnparsedMessage: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if b.zoneState["001"] || zoneState() != "on" {
+		t.Errorf("got state %q with zone 001 faulted %v; wanted %q", zoneState(), b.zoneState["001"], "on")
+	}
+
+	// Everything is clear.
+	err := b.handleMessage(alarmdecoder.Message{Ready: true, UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if zoneState() != "off" {
+		t.Errorf("got state %q; wanted %q", zoneState(), "off")
+	}
+}
+
+func TestRemoveOnShutdown(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{"005": {Name: "door"}})
+
+	err := b.handleMessage(alarmdecoder.Message{Zone: "005", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// By default, the entities are kept.
+	err = b.shutdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := client.get("homeassistant/binary_sensor/door/state"); value != "on" {
+		t.Errorf("got zone state %q; wanted %q", value, "on")
+	}
+
+	b.removeOnShutdown = true
+	err = b.shutdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range []string{
+		"homeassistant/alarm_control_panel/ad2mqtt/config",
+		"homeassistant/alarm_control_panel/ad2mqtt/state",
+		"homeassistant/binary_sensor/ad2mqtt/ac_power/config",
+		"homeassistant/binary_sensor/door/config",
+		"homeassistant/binary_sensor/door/state",
+	} {
+		if value, count := client.get(topic); value != "" || count == 0 {
+			t.Errorf("expected %s to be cleared, got %q", topic, value)
+		}
+	}
+
+	if value, _ := client.get("homeassistant/alarm_control_panel/ad2mqtt/availability"); value != "offline" {
+		t.Errorf("got availability %q; wanted %q", value, "offline")
+	}
+}
+
+func TestPanelDisabled(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{"005": {Name: "door"}})
+	b.panelEnabled = false
+
+	err := b.republish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.handleMessage(alarmdecoder.Message{Zone: "005", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := client.get("homeassistant/alarm_control_panel/ad2mqtt/config"); value != "" {
+		t.Errorf("expected no alarm panel config, got %q", value)
+	}
+
+	if _, count := client.get("homeassistant/alarm_control_panel/ad2mqtt/state"); count != 0 {
+		t.Errorf("expected no alarm state to be published")
+	}
+
+	if value, _ := client.get("homeassistant/binary_sensor/door/state"); value != "on" {
+		t.Errorf("got zone state %q; wanted %q", value, "on")
+	}
+}
+
+func TestFireLatch(t *testing.T) {
+	b, client := newTestBridge(nil)
+
+	fire := func() string {
+		value, _ := client.get("homeassistant/binary_sensor/ad2mqtt/fire/state")
+		return value
+	}
+
+	// The fire bit flickers while the alarm sounds.
+	for _, msg := range []alarmdecoder.Message{
+		{Fire: true, AlarmSounding: true, UnparsedMessage: "test"},
+		{AlarmSounding: true, UnparsedMessage: "test"},
+	} {
+		err := b.handleMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fire() != "on" {
+			t.Fatalf("got fire %q; wanted %q", fire(), "on")
+		}
+	}
+
+	// Disarming clears it.
+	err := b.handleMessage(alarmdecoder.Message{Ready: true, UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fire() != "off" {
+		t.Errorf("got fire %q after disarming; wanted %q", fire(), "off")
+	}
+
+	// So does a disarm command.
+	err = b.handleMessage(alarmdecoder.Message{Fire: true, UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.codeLength = 4
+	b.ad = alarmdecoder.New(&keyRecorder{})
+	b.ad.SetKeyDelay(0)
+	b.handleCommand(b.partitions[0], []byte(`{"action": "DISARM", "code": "1234"}`))
+
+	if fire() != "off" {
+		t.Errorf("got fire %q after the disarm command; wanted %q", fire(), "off")
+	}
+}
+
+// failingClient fails all publishes while fail is set.
+type failingClient struct {
+	*dummyClient
+
+	fail bool
+}
+
+func (c *failingClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if c.fail {
+		return &errorToken{err: errors.New("not connected")}
+	}
+
+	return c.dummyClient.Publish(topic, qos, retained, payload)
+}
+
+func TestPublishFailure(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{"005": {Name: "door"}})
+	failing := &failingClient{dummyClient: client, fail: true}
+	b.mqttClient = failing
+
+	// The broker is unreachable, the bridge keeps going.
+	b.processMessage(alarmdecoder.Message{Zone: "005", UnparsedMessage: "test"})
+	if !b.stale {
+		t.Fatalf("expected the state to be marked stale")
+	}
+
+	// Once it's back, the missed state gets republished.
+	failing.fail = false
+	b.processMessage(alarmdecoder.Message{Zone: "005", UnparsedMessage: "test"})
+	if b.stale {
+		t.Errorf("expected the state to be republished")
+	}
+
+	if value, _ := client.get("homeassistant/binary_sensor/door/state"); value != "on" {
+		t.Errorf("got zone state %q; wanted %q", value, "on")
+	}
+}
+
+func TestZoneQuery(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{"005": {Name: "door"}})
+
+	err := b.handleMessage(alarmdecoder.Message{Zone: "005", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, count := client.get("homeassistant/binary_sensor/door/state")
+
+	b.handleZoneQuery("door\n")
+	value, newCount := client.get("homeassistant/binary_sensor/door/state")
+	if value != "on" || newCount != count+1 {
+		t.Errorf("got state %q after %d publishes; wanted %q after %d", value, newCount, "on", count+1)
+	}
+
+	// Unknown zones are ignored.
+	b.handleZoneQuery("window")
+	if _, count := client.get("homeassistant/binary_sensor/window/state"); count != 0 {
+		t.Errorf("expected no state for an unknown zone")
+	}
+}
+
+func TestPublishSettings(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{"005": {Name: "door"}})
+	b.qos = 1
+	b.retain = false
+
+	err := b.republish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.handleMessage(alarmdecoder.Message{Zone: "005", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The discovery configuration is always retained.
+	for topic, retained := range map[string]bool{
+		"homeassistant/binary_sensor/door/config": true,
+		"homeassistant/binary_sensor/door/state":  false,
+	} {
+		if client.retained[topic] != retained || client.qos[topic] != 1 {
+			t.Errorf("got retained %v at QoS %d for %s; wanted %v at QoS 1", client.retained[topic], client.qos[topic], topic, retained)
+		}
+	}
+}
+
+func TestLastAlarmZone(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{
+		"005": {Name: "front_door", FriendlyName: "Front door"},
+		"006": {Name: "window"},
+	})
+
+	lastZone := func() string {
+		value, _ := client.get("homeassistant/sensor/ad2mqtt/last_alarm_zone/state")
+		return value
+	}
+
+	// The alarm message reports the zone.
+	for _, msg := range []alarmdecoder.Message{
+		{ArmedAway: true, KeypadMessage: "ARMED ***AWAY***", UnparsedMessage: "test"},
+		{ArmedAway: true, AlarmSounding: true, Zone: "005", KeypadMessage: "ALARM 05", UnparsedMessage: "test"},
+	} {
+		err := b.handleMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if lastZone() != "Front door (zone 005)" {
+		t.Errorf("got last alarm zone %q; wanted %q", lastZone(), "Front door (zone 005)")
+	}
+
+	// It's kept after disarming and cleared when arming again.
+	for _, msg := range []alarmdecoder.Message{
+		{Ready: true, KeypadMessage: "READY", UnparsedMessage: "test"},
+		{Zone: "006", UnparsedMessage: "test"},
+	} {
+		err := b.handleMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if lastZone() != "Front door (zone 005)" {
+		t.Errorf("got last alarm zone %q after disarming; wanted %q", lastZone(), "Front door (zone 005)")
+	}
+
+	// Without a zone in the alarm message, the last fault is used.
+	for _, msg := range []alarmdecoder.Message{
+		{ArmedHome: true, KeypadMessage: "ARMED ***STAY***", UnparsedMessage: "test"},
+		{ArmedHome: true, AlarmSounding: true, UnparsedMessage: "test"},
+	} {
+		err := b.handleMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !msg.AlarmSounding && lastZone() != "" {
+			t.Errorf("expected the last alarm zone to be cleared when arming, got %q", lastZone())
+		}
+	}
+
+	if lastZone() != "window (zone 006)" {
+		t.Errorf("got last alarm zone %q; wanted %q", lastZone(), "window (zone 006)")
+	}
+}
+
+func TestFilterDuplicates(t *testing.T) {
+	b, client := newTestBridge(nil)
+	b.filterDuplicates = true
+	b.duplicateInterval = 10 * time.Second
+
+	clock := &fakeClock{now: time.Now()}
+	b.clock = clock
+
+	topic := "homeassistant/sensor/ad2mqtt/keypad/state"
+	msg := alarmdecoder.Message{Ready: true, KeypadMessage: "READY", UnparsedMessage: "ready"}
+
+	b.processMessage(msg)
+	first := b.lastMessage
+
+	// Repeats get dropped.
+	clock.Advance(time.Second)
+	b.processMessage(msg)
+	if !b.lastMessage.Equal(first) {
+		t.Errorf("expected the repeated message to be dropped")
+	}
+
+	// Until the interval is over.
+	clock.Advance(10 * time.Second)
+	b.processMessage(msg)
+	if b.lastMessage.Equal(first) {
+		t.Errorf("expected the repeated message to go through after the interval")
+	}
+
+	// Different messages always go through.
+	b.processMessage(alarmdecoder.Message{KeypadMessage: "FAULT 05", UnparsedMessage: "fault"})
+	if value, _ := client.get(topic); value != "FAULT 05" {
+		t.Errorf("got keypad %q; wanted %q", value, "FAULT 05")
+	}
+}
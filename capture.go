@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// captureBuffer is the number of reads which can be queued for writing to
+// the capture file before new data gets dropped.
+const captureBuffer = 1024
+
+// captureChunk is data read from the AlarmDecoder along with when it was read.
+type captureChunk struct {
+	data []byte
+	at   time.Time
+}
+
+// capturePort records everything read from the AlarmDecoder to a file, in the
+// format understood by the replay mode.
+type capturePort struct {
+	io.ReadWriteCloser
+
+	lock    sync.Mutex
+	closed  bool
+	chunks  chan captureChunk
+	dropped int
+}
+
+// openCapture wraps the port so everything read from it gets appended to the
+// capture file. Writing to the file happens in the background so a slow disk
+// can't hold up the processing of messages.
+func openCapture(port io.ReadWriteCloser, path string) (io.ReadWriteCloser, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open the capture file: %w", err)
+	}
+
+	p := &capturePort{
+		ReadWriteCloser: port,
+		chunks:          make(chan captureChunk, captureBuffer),
+	}
+
+	go p.capture(f)
+
+	return p, nil
+}
+
+// capture writes the queued data to the file, one timestamped line at a time.
+func (p *capturePort) capture(f *os.File) {
+	defer f.Close()
+
+	var line []byte
+	for chunk := range p.chunks {
+		data := chunk.data
+		for len(data) > 0 {
+			i := bytes.IndexAny(data, "\r\n")
+			if i < 0 {
+				line = append(line, data...)
+				break
+			}
+
+			line = append(line, data[:i]...)
+			data = data[i+1:]
+
+			if len(line) == 0 {
+				// Second half of a \r\n.
+				continue
+			}
+
+			_, err := fmt.Fprintf(f, "%s %s\n", chunk.at.Format(captureTimeFormat), line)
+			if err != nil {
+				logErrorf("[alarm] Failed to write to the capture file: %v", err)
+			}
+
+			line = line[:0]
+		}
+	}
+}
+
+// Read reads from the port, queuing the data for the capture file.
+func (p *capturePort) Read(b []byte) (int, error) {
+	n, err := p.ReadWriteCloser.Read(b)
+	if n > 0 {
+		data := make([]byte, n)
+		copy(data, b[:n])
+
+		p.lock.Lock()
+		if !p.closed {
+			select {
+			case p.chunks <- captureChunk{data: data, at: time.Now()}:
+			default:
+				p.dropped++
+				if p.dropped == 1 {
+					logWarnf("[alarm] Capture file can't keep up, dropping data")
+				}
+			}
+		}
+		p.lock.Unlock()
+	}
+
+	return n, err
+}
+
+// Close closes the port and the capture file once all queued data is written.
+func (p *capturePort) Close() error {
+	p.lock.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.chunks)
+	}
+	p.lock.Unlock()
+
+	return p.ReadWriteCloser.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+func TestCapture(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.txt")
+	capture := filepath.Join(dir, "capture.txt")
+
+	err := os.WriteFile(source, []byte("[00000000011000003A--],,,\"one\"\r\n[00000000011000003A--],,,\"two\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := openReplay(source, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err = openCapture(port, capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ad := alarmdecoder.New(port)
+	for i := 0; i < 2; i++ {
+		_, err := ad.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	port.Close()
+
+	// The capture gets written in the background.
+	var lines []string
+	for i := 0; i < 100; i++ {
+		content, err := os.ReadFile(capture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines = strings.Split(strings.TrimSpace(string(content)), "\n")
+		if len(lines) == 2 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("got %d captured lines; wanted 2", len(lines))
+	}
+
+	for i, want := range []string{`"one"`, `"two"`} {
+		fields := strings.SplitN(lines[i], " ", 2)
+		_, err := time.Parse(captureTimeFormat, fields[0])
+		if err != nil || len(fields) != 2 || !strings.HasSuffix(fields[1], want) {
+			t.Errorf("unexpected captured line %q", lines[i])
+		}
+	}
+}
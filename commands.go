@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+// handleCommand processes a command received from Home Assistant for a partition.
+func (b *bridge) handleCommand(p *partition, value []byte) {
+	type mqttAction struct {
+		Action string `json:"action"`
+		Code   string `json:"code"`
+		Zone   string `json:"zone"`
+		Force  bool   `json:"force"`
+	}
+
+	var action mqttAction
+	err := json.Unmarshal(value, &action)
+	if err != nil {
+		logErrorf("[mqtt] Failed to parse action: %v", err)
+	}
+
+	b.lock.Lock()
+	mode := b.mode
+	blocker, blocked := "", false
+	if p.faulted {
+		blocker, blocked = b.armingBlocked()
+	}
+
+	// Ignore repeated commands, typing a code twice can lock out the panel.
+	now := b.clock.Now()
+	command := action.Action + ":" + action.Code
+	duplicate := b.commandDebounce > 0 && command == p.lastCommand && now.Sub(p.lastCommandAt) < b.commandDebounce
+	if !duplicate {
+		p.lastCommand = command
+		p.lastCommandAt = now
+	}
+	b.lock.Unlock()
+
+	if duplicate {
+		logWarnf("[mqtt] Ignoring repeated %s command", action.Action)
+		return
+	}
+
+	b.adLock.Lock()
+	defer b.adLock.Unlock()
+
+	switch action.Action {
+	case "ARM_HOME", "ARM_AWAY", "ARM_NIGHT":
+		if !stringInSlice(action.Action, b.armActions) {
+			b.notify(p, fmt.Sprintf("Refusing %s as it isn't an allowed arming mode", action.Action))
+			return
+		}
+
+		// Don't arm with a faulted zone unless explicitly asked to.
+		if blocked && !action.Force {
+			if blocker != "" {
+				b.notify(p, fmt.Sprintf("Refusing %s as the alarm isn't ready to arm (%s is open)", action.Action, blocker))
+			} else {
+				b.notify(p, fmt.Sprintf("Refusing %s as the alarm isn't ready to arm", action.Action))
+			}
+
+			return
+		}
+
+		// Quick arm unless a valid code was provided.
+		code := action.Code
+		err := validateCode(code, b.codeLength)
+		if err != nil && b.codeArmRequired {
+			b.notify(p, fmt.Sprintf("Refusing %s without a valid code: %v", action.Action, err))
+			return
+		} else if err != nil {
+			code = ""
+		}
+
+		keypad := p.keypad(b.ad)
+		template := b.keyTemplates[action.Action]
+		if template != "" {
+			if code == "" && strings.Contains(template, "{code}") {
+				logErrorf("[mqtt] Failed to arm: %v", validateCode(action.Code, b.codeLength))
+				return
+			}
+
+			err = keypad.SendKeys(expandKeyTemplate(template, code))
+		} else {
+			err = arm(keypad, action.Action, code)
+		}
+
+		logSendError(err)
+		b.metrics.commandSent(action.Action)
+		b.expectState(p, action.Action)
+
+		logInfof("[mqtt] Armed (%s)", strings.ToLower(strings.TrimPrefix(action.Action, "ARM_")))
+	case "DISARM", "CLEAR":
+		// Disarming without a code needs a key template which doesn't use it.
+		code := action.Code
+		template := b.keyTemplates["DISARM"]
+		err := validateCode(code, b.codeLength)
+		if err != nil && (b.codeDisarmRequired || template == "" || strings.Contains(template, "{code}")) {
+			logErrorf("[mqtt] Failed to disarm: %v", err)
+			return
+		} else if err != nil {
+			code = ""
+		}
+
+		keypad := p.keypad(b.ad)
+		disarm := func() error {
+			if template != "" {
+				return keypad.SendKeys(expandKeyTemplate(template, code))
+			}
+
+			return keypad.Disarm(code)
+		}
+
+		logSendError(disarm())
+
+		// The panel only forgets about a past alarm once disarmed a second
+		// time, as done from the keypad.
+		if action.Action == "CLEAR" {
+			<-b.clock.After(b.clearDelay)
+			logSendError(disarm())
+		}
+
+		b.metrics.commandSent(action.Action)
+		b.expectState(p, action.Action)
+
+		// Disarming acknowledges any fire alarm.
+		b.lock.Lock()
+		b.fireLatched = false
+		err = b.updateFireSensor()
+		b.lock.Unlock()
+		if err != nil {
+			logErrorf("[mqtt] Failed to clear the fire alarm: %v", err)
+		}
+
+		if action.Action == "CLEAR" {
+			logInfof("[mqtt] Disarmed and cleared the alarm memory")
+		} else {
+			logInfof("[mqtt] Disarmed")
+		}
+	case "PANIC_FIRE", "PANIC_POLICE", "PANIC_AUX":
+		if !b.panicEnabled {
+			logWarnf("[mqtt] Refusing %s as panic commands are disabled", action.Action)
+			return
+		}
+
+		err := validateCode(action.Code, b.codeLength)
+		if err != nil && b.codeTriggerRequired {
+			b.notify(p, fmt.Sprintf("Refusing %s without a valid code: %v", action.Action, err))
+			return
+		}
+
+		logSendError(p.keypad(b.ad).SendKeys(b.panicKeys[action.Action]))
+		b.metrics.commandSent(action.Action)
+
+		logInfof("[mqtt] Triggered %s panic", strings.ToLower(strings.TrimPrefix(action.Action, "PANIC_")))
+	case "RESYNC":
+		b.lock.Lock()
+		err := b.publishState()
+		b.lock.Unlock()
+		if err != nil {
+			logErrorf("[mqtt] Failed to resync: %v", err)
+			return
+		}
+
+		logInfof("[mqtt] Resynced the alarm and zone states")
+	case "DEBUG":
+		b.lock.Lock()
+		err := b.publishDebug()
+		b.lock.Unlock()
+		if err != nil {
+			logErrorf("[mqtt] Failed to publish the debug state: %v", err)
+			return
+		}
+
+		logInfof("[mqtt] Published the debug state")
+	case "REFRESH_FAULTS":
+		// Ademco panels list the faulted zones when pressing *.
+		if mode == "D" {
+			b.notify(p, "Refusing REFRESH_FAULTS as it's only supported on Ademco panels")
+			return
+		}
+
+		b.startFaultRefresh()
+		logSendError(p.keypad(b.ad).SendKeys("*"))
+		b.metrics.commandSent(action.Action)
+
+		logInfof("[mqtt] Requested the faulted zones")
+	case "BYPASS":
+		zone, err := strconv.Atoi(action.Zone)
+		if err != nil || zone <= 0 {
+			logErrorf("[mqtt] Failed to bypass: Invalid zone %q", action.Zone)
+			return
+		}
+
+		logSendError(p.keypad(b.ad).Bypass("", zone))
+		b.metrics.commandSent(action.Action)
+
+		logInfof("[mqtt] Bypassed zone %02d", zone)
+	}
+}
+
+// notify logs a problem with a command and reports it on the partition's
+// notification topic.
+func (b *bridge) notify(p *partition, message string) {
+	logWarnf("[mqtt] %s", message)
+	b.publishNotification(p, message)
+}
+
+// publishNotification publishes a message on the partition's notification topic.
+func (b *bridge) publishNotification(p *partition, message string) {
+	if token := b.mqttClient.Publish(b.partitionTopic(p, "notification"), b.qos, false, message); token.Wait() && token.Error() != nil {
+		b.metrics.publishFailed()
+		logErrorf("[mqtt] Failed to publish notification: %v", token.Error())
+	}
+}
+
+// arm arms the panel in the mode of an arming action, using the panel's
+// default key sequence.
+func arm(keypad alarmdecoder.Commander, action string, code string) error {
+	switch action {
+	case "ARM_HOME":
+		return keypad.ArmHome(code)
+	case "ARM_AWAY":
+		return keypad.ArmAway(code)
+	case "ARM_NIGHT":
+		return keypad.ArmNight(code)
+	}
+
+	return nil
+}
+
+// expandKeyTemplate returns the key sequence of a template, replacing
+// {code} by the code.
+func expandKeyTemplate(template string, code string) string {
+	return strings.ReplaceAll(template, "{code}", code)
+}
+
+// validateKeyTemplate checks that a key template only contains keys which can
+// be sent to the panel, along with the {code} placeholder.
+func validateKeyTemplate(action string, template string, codeRequired bool) error {
+	keys := strings.ReplaceAll(template, "{code}", "")
+	for _, c := range keys {
+		if (c < '0' || c > '9') && c != '*' && c != '#' && (c < '\x01' || c > '\x08') {
+			return fmt.Errorf("Invalid key %q in the %s key template", c, action)
+		}
+	}
+
+	if codeRequired && !strings.Contains(template, "{code}") {
+		return fmt.Errorf("The %s key template must contain {code} as a code is required", action)
+	}
+
+	return nil
+}
+
+// validateCode checks that a code received from Home Assistant is safe to
+// send to the panel.
+func validateCode(code string, length int) error {
+	// Home Assistant renders a missing code as "None".
+	if code == "" || code == "None" {
+		return fmt.Errorf("No code provided")
+	}
+
+	if len(code) != length {
+		return fmt.Errorf("Code must be %d digits long", length)
+	}
+
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return fmt.Errorf("Code must only contain digits")
+		}
+	}
+
+	return nil
+}
+
+// logSendError logs the failure to send keys to the panel, if any.
+func logSendError(err error) {
+	if errors.Is(err, alarmdecoder.ErrReadOnly) {
+		logWarnf("[mqtt] Refusing to send keys to the alarm in read-only mode")
+	} else if err != nil {
+		logErrorf("[mqtt] Failed to send keys to the alarm: %v", err)
+	}
+}
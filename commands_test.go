@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+	"github.com/stgraber/ad2mqtt/decoder/decodertest"
+)
+
+func TestValidateCode(t *testing.T) {
+	cases := []struct {
+		code  string
+		valid bool
+	}{
+		{"1234", true},
+		{"0000", true},
+		{"", false},
+		{"None", false},
+		{"123", false},
+		{"12345", false},
+		{"12a4", false},
+		{"12 4", false},
+		{"#123", false},
+	}
+
+	for _, c := range cases {
+		err := validateCode(c.code, 4)
+		if c.valid && err != nil {
+			t.Errorf("validateCode(%q) failed: %v", c.code, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("validateCode(%q) should have failed", c.code)
+		}
+	}
+
+	err := validateCode("123456", 6)
+	if err != nil {
+		t.Errorf("validateCode(%q) with a 6 digit length failed: %v", "123456", err)
+	}
+}
+
+// keyRecorder records the keys sent to the panel, along with the number of
+// writes.
+type keyRecorder struct {
+	bytes.Buffer
+	writes int
+}
+
+func (r *keyRecorder) Write(p []byte) (int, error) {
+	r.writes++
+	return r.Buffer.Write(p)
+}
+
+func (r *keyRecorder) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func TestPanicCommands(t *testing.T) {
+	b, _ := newTestBridge(nil)
+	b.panicKeys = map[string]string{"PANIC_FIRE": "\x01\x01\x01"}
+
+	keys := &keyRecorder{}
+	b.ad = alarmdecoder.New(keys)
+	b.ad.SetKeyDelay(0)
+
+	// Panic commands are disabled by default.
+	b.handleCommand(b.partitions[0], []byte(`{"action": "PANIC_FIRE"}`))
+	if keys.Len() != 0 {
+		t.Fatalf("expected no keys to be sent, got %q", keys.String())
+	}
+
+	b.panicEnabled = true
+	b.handleCommand(b.partitions[0], []byte(`{"action": "PANIC_FIRE"}`))
+	if keys.String() != "\x01\x01\x01" {
+		t.Errorf("got keys %q; wanted %q", keys.String(), "\x01\x01\x01")
+	}
+}
+
+func TestArmCommands(t *testing.T) {
+	cases := []struct {
+		mode     string
+		template string
+		payload  string
+		want     string
+	}{
+		{"A", "", `{"action": "ARM_AWAY"}`, "#2"},
+		{"A", "", `{"action": "ARM_HOME", "code": "1234"}`, "12343"},
+		{"D", "", `{"action": "ARM_AWAY"}`, "\x05\x05\x05"},
+		{"D", "", `{"action": "DISARM", "code": "1234"}`, "1234"},
+		{"A", "", `{"action": "DISARM", "code": "1234"}`, "12341"},
+		{"A", "*2", `{"action": "ARM_AWAY"}`, "*2"},
+		{"A", "{code}2", `{"action": "ARM_AWAY", "code": "1234"}`, "12342"},
+		{"A", "{code}2", `{"action": "ARM_AWAY"}`, ""},
+		{"D", "{code}#", `{"action": "DISARM", "code": "1234"}`, "1234#"},
+	}
+
+	for i, c := range cases {
+		b, _ := newTestBridge(nil)
+		b.codeLength = 4
+		b.keyTemplates = map[string]string{"ARM_AWAY": c.template, "DISARM": c.template}
+
+		keys := &keyRecorder{}
+		b.ad = alarmdecoder.New(keys)
+		b.ad.SetKeyDelay(0)
+		b.ad.SetMode(c.mode)
+
+		b.handleCommand(b.partitions[0], []byte(c.payload))
+		if keys.String() != c.want {
+			t.Errorf("%d. got keys %q for %s in mode %q; wanted %q", i, keys.String(), c.payload, c.mode, c.want)
+		}
+	}
+}
+
+func TestClearCommand(t *testing.T) {
+	b, _ := newTestBridge(nil)
+	b.codeLength = 4
+	b.clearDelay = time.Second
+
+	clock := &fakeClock{now: time.Now()}
+	b.clock = clock
+
+	keys := &keyRecorder{}
+	b.ad = alarmdecoder.New(keys)
+	b.ad.SetKeyDelay(0)
+
+	// The disarm sequence is sent twice.
+	b.handleCommand(b.partitions[0], []byte(`{"action": "CLEAR", "code": "1234"}`))
+	if keys.String() != "1234112341" {
+		t.Errorf("got keys %q; wanted %q", keys.String(), "1234112341")
+	}
+
+	// Using the disarm template when set.
+	keys.Reset()
+	b.keyTemplates = map[string]string{"DISARM": "{code}#"}
+	b.handleCommand(b.partitions[0], []byte(`{"action": "CLEAR", "code": "5678"}`))
+	if keys.String() != "5678#5678#" {
+		t.Errorf("got keys %q; wanted %q", keys.String(), "5678#5678#")
+	}
+
+	// A code is still required.
+	keys.Reset()
+	b.handleCommand(b.partitions[0], []byte(`{"action": "CLEAR"}`))
+	if keys.Len() != 0 {
+		t.Errorf("expected no keys to be sent, got %q", keys.String())
+	}
+}
+
+func TestForcedMode(t *testing.T) {
+	for _, forced := range []bool{true, false} {
+		b, _ := newTestBridge(nil)
+		b.codeLength = 4
+		b.mode = "D"
+		b.modeForced = forced
+
+		panel := decodertest.NewPanel(`[10000001100000003A--],,,"READY"`)
+		b.ad = b.newDecoder(panel)
+		b.ad.SetKeyDelay(0)
+
+		msg, err := b.ad.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = b.handleMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Keypad messages only override the mode unless configured.
+		want := "1234"
+		if !forced {
+			want = "12341"
+		}
+
+		b.handleCommand(b.partitions[0], []byte(`{"action": "DISARM", "code": "1234"}`))
+		if panel.Written() != want {
+			t.Errorf("got keys %q with the mode forced %v; wanted %q", panel.Written(), forced, want)
+		}
+
+		panel.Close()
+	}
+}
+
+func TestValidateKeyTemplate(t *testing.T) {
+	cases := []struct {
+		action   string
+		template string
+		required bool
+		valid    bool
+	}{
+		{"ARM_AWAY", "#2", false, true},
+		{"ARM_AWAY", "{code}2", false, true},
+		{"ARM_AWAY", "\x05\x05\x05", false, true},
+		{"ARM_AWAY", "#2\r", false, false},
+		{"ARM_AWAY", "{cod}2", false, false},
+		{"ARM_AWAY", "#2", true, false},
+		{"DISARM", "{code}1", true, true},
+		{"DISARM", "1", true, false},
+		{"DISARM", "1", false, true},
+	}
+
+	for _, c := range cases {
+		err := validateKeyTemplate(c.action, c.template, c.required)
+		if c.valid && err != nil {
+			t.Errorf("validateKeyTemplate(%q, %q) failed: %v", c.action, c.template, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("validateKeyTemplate(%q, %q) should have failed", c.action, c.template)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	b, client := newTestBridge(nil)
+	b.codeLength = 4
+	b.readOnly = true
+
+	keys := &keyRecorder{}
+	b.ad = alarmdecoder.New(keys)
+	b.ad.SetKeyDelay(0)
+	b.ad.SetReadOnly(true)
+
+	err := b.setupMQTT()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the zone queries are subscribed to.
+	if len(client.subscribed) != 1 || client.subscribed[0] != b.zoneQueryTopic() {
+		t.Errorf("got subscriptions %v", client.subscribed)
+	}
+
+	config := b.panelConfig(b.partitions[0])
+	if len(config.SupportedFeatures) != 0 {
+		t.Errorf("got supported features %v", config.SupportedFeatures)
+	}
+
+	if config.CommandTopic != "" || config.CommandTemplate != "" {
+		t.Errorf("got command topic %q with template %q", config.CommandTopic, config.CommandTemplate)
+	}
+
+	// Nothing gets written even if a command makes it through.
+	b.handleCommand(b.partitions[0], []byte(`{"action": "DISARM", "code": "1234"}`))
+	if keys.Len() != 0 {
+		t.Errorf("expected no keys to be sent, got %q", keys.String())
+	}
+}
+
+func TestCodeRequired(t *testing.T) {
+	b, client := newTestBridge(nil)
+	b.codeLength = 4
+	b.codeArmRequired = true
+	b.codeTriggerRequired = true
+	b.panicEnabled = true
+	b.panicKeys = map[string]string{"PANIC_FIRE": "\x01\x01\x01"}
+
+	keys := &keyRecorder{}
+	b.ad = alarmdecoder.New(keys)
+	b.ad.SetKeyDelay(0)
+
+	// Arming and panic commands need a code.
+	b.handleCommand(b.partitions[0], []byte(`{"action": "ARM_AWAY"}`))
+	b.handleCommand(b.partitions[0], []byte(`{"action": "PANIC_FIRE"}`))
+	if keys.Len() != 0 {
+		t.Errorf("expected no keys to be sent, got %q", keys.String())
+	}
+
+	if value, _ := client.get("homeassistant/alarm_control_panel/ad2mqtt/notification"); !strings.Contains(value, "without a valid code") {
+		t.Errorf("got notification %q", value)
+	}
+
+	b.handleCommand(b.partitions[0], []byte(`{"action": "ARM_AWAY", "code": "1234"}`))
+	if keys.String() != "12342" {
+		t.Errorf("got keys %q; wanted %q", keys.String(), "12342")
+	}
+
+	// Disarming without a code works with a template not using it.
+	keys.Reset()
+	b.codeDisarmRequired = false
+	b.keyTemplates = map[string]string{"DISARM": "*1"}
+	b.handleCommand(b.partitions[0], []byte(`{"action": "DISARM"}`))
+	if keys.String() != "*1" {
+		t.Errorf("got keys %q; wanted %q", keys.String(), "*1")
+	}
+
+	// Unless a code is required.
+	keys.Reset()
+	b.codeDisarmRequired = true
+	b.handleCommand(b.partitions[0], []byte(`{"action": "DISARM"}`))
+	if keys.Len() != 0 {
+		t.Errorf("expected no keys to be sent, got %q", keys.String())
+	}
+
+	config := b.panelConfig(b.partitions[0])
+	if !config.CodeArmRequired || !config.CodeDisarmRequired || !config.CodeTriggerRequired {
+		t.Errorf("got config %+v", config)
+	}
+}
+
+func TestResyncCommand(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{"005": {Name: "door"}})
+
+	err := b.handleMessage(alarmdecoder.Message{Zone: "005", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, stateCount := client.get("homeassistant/alarm_control_panel/ad2mqtt/state")
+	_, zoneCount := client.get("homeassistant/binary_sensor/door/state")
+
+	b.handleCommand(b.partitions[0], []byte(`{"action": "RESYNC"}`))
+
+	state, newStateCount := client.get("homeassistant/alarm_control_panel/ad2mqtt/state")
+	zoneState, newZoneCount := client.get("homeassistant/binary_sensor/door/state")
+	if state != "disarmed" || newStateCount != stateCount+1 {
+		t.Errorf("got state %q after %d publishes; wanted %q after %d", state, newStateCount, "disarmed", stateCount+1)
+	}
+
+	if zoneState != "on" || newZoneCount != zoneCount+1 {
+		t.Errorf("got zone state %q after %d publishes; wanted %q after %d", zoneState, newZoneCount, "on", zoneCount+1)
+	}
+}
+
+func TestDebugCommand(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{"005": {Name: "door"}})
+
+	err := b.handleMessage(alarmdecoder.Message{Zone: "005", KeypadMessage: "FAULT 05", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.handleCommand(b.partitions[0], []byte(`{"action": "DEBUG"}`))
+
+	data, _ := client.get("homeassistant/alarm_control_panel/ad2mqtt/debug")
+
+	var state debugState
+	err = json.Unmarshal([]byte(data), &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.UnparsedMessage != "test" || state.Message.KeypadMessage != "FAULT 05" {
+		t.Errorf("got last message %q (%q)", state.UnparsedMessage, state.Message.KeypadMessage)
+	}
+
+	if !state.ZoneState["005"] || state.AlarmState[0] != "disarmed" {
+		t.Errorf("got zone state %v and alarm state %v", state.ZoneState, state.AlarmState)
+	}
+}
+
+func TestPublishParseError(t *testing.T) {
+	b, client := newTestBridge(nil)
+	topic := "homeassistant/alarm_control_panel/ad2mqtt/parse_errors"
+
+	_, err := alarmdecoder.ParseMessage("!RFX:bad")
+	if err == nil {
+		t.Fatal("expected the message to fail to parse")
+	}
+
+	// Disabled by default.
+	b.publishParseError(err)
+	if _, count := client.get(topic); count != 0 {
+		t.Fatalf("expected no parse error to be published, got %d", count)
+	}
+
+	b.publishParseErrors = true
+	b.publishParseError(err)
+
+	data, _ := client.get(topic)
+
+	var report parseErrorReport
+	err = json.Unmarshal([]byte(data), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Line != "!RFX:bad" || report.Field != "RFX message" || report.Error == "" || client.retained[topic] {
+		t.Errorf("got report %+v (retained %v)", report, client.retained[topic])
+	}
+}
+
+func TestArmNotReady(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{"005": {Name: "door"}})
+	b.armActions = []string{"ARM_AWAY", "ARM_HOME"}
+
+	keys := &keyRecorder{}
+	b.ad = alarmdecoder.New(keys)
+	b.ad.SetKeyDelay(0)
+
+	// A door is open.
+	err := b.handleMessage(alarmdecoder.Message{Zone: "005", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.handleCommand(b.partitions[0], []byte(`{"action": "ARM_AWAY"}`))
+	if keys.Len() != 0 {
+		t.Errorf("expected no keys to be sent, got %q", keys.String())
+	}
+
+	if value, _ := client.get("homeassistant/alarm_control_panel/ad2mqtt/notification"); !strings.Contains(value, "isn't ready") {
+		t.Errorf("got notification %q", value)
+	}
+
+	// Forcing it goes through.
+	b.handleCommand(b.partitions[0], []byte(`{"action": "ARM_AWAY", "force": true}`))
+	if keys.String() != "#2" {
+		t.Errorf("got keys %q; wanted %q", keys.String(), "#2")
+	}
+
+	// Modes which aren't allowed are always refused.
+	keys.Reset()
+	b.handleCommand(b.partitions[0], []byte(`{"action": "ARM_NIGHT", "force": true}`))
+	if keys.Len() != 0 {
+		t.Errorf("expected no keys to be sent, got %q", keys.String())
+	}
+}
+
+func TestArmIgnoredTypes(t *testing.T) {
+	blocks := true
+	b, client := newTestBridge(map[string]zone{
+		"005": {Name: "hallway", Type: "motion"},
+		"006": {Name: "garage", Type: "motion", BlocksArming: &blocks},
+	})
+
+	keys := &keyRecorder{}
+	b.ad = alarmdecoder.New(keys)
+	b.ad.SetKeyDelay(0)
+
+	// A faulted motion sensor doesn't prevent arming.
+	err := b.handleMessage(alarmdecoder.Message{Zone: "005", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.handleCommand(b.partitions[0], []byte(`{"action": "ARM_AWAY"}`))
+	if keys.String() != "#2" {
+		t.Errorf("got keys %q; wanted %q", keys.String(), "#2")
+	}
+
+	// Unless configured to.
+	keys.Reset()
+	err = b.handleMessage(alarmdecoder.Message{Zone: "006", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.handleCommand(b.partitions[0], []byte(`{"action": "ARM_HOME"}`))
+	if keys.Len() != 0 {
+		t.Errorf("expected no keys to be sent, got %q", keys.String())
+	}
+
+	if value, _ := client.get("homeassistant/alarm_control_panel/ad2mqtt/notification"); !strings.Contains(value, "garage is open") {
+		t.Errorf("got notification %q", value)
+	}
+}
+
+func TestCommandDebounce(t *testing.T) {
+	b, _ := newTestBridge(nil)
+	b.codeLength = 4
+	b.commandDebounce = 2 * time.Second
+
+	clock := &fakeClock{now: time.Now()}
+	b.clock = clock
+
+	keys := &keyRecorder{}
+	b.ad = alarmdecoder.New(keys)
+	b.ad.SetKeyDelay(0)
+
+	// The second disarm is ignored.
+	b.handleCommand(b.partitions[0], []byte(`{"action": "DISARM", "code": "1234"}`))
+	b.handleCommand(b.partitions[0], []byte(`{"action": "DISARM", "code": "1234"}`))
+	if keys.String() != "12341" {
+		t.Errorf("got keys %q; wanted %q", keys.String(), "12341")
+	}
+
+	// Once the window is over, it goes through.
+	clock.Advance(3 * time.Second)
+	b.handleCommand(b.partitions[0], []byte(`{"action": "DISARM", "code": "1234"}`))
+	if keys.String() != "1234112341" {
+		t.Errorf("got keys %q; wanted %q", keys.String(), "1234112341")
+	}
+}
+
+func TestCommandConfirmation(t *testing.T) {
+	b, client := newTestBridge(nil)
+	b.codeLength = 4
+	b.confirmTimeout = 10 * time.Second
+
+	clock := &fakeClock{now: time.Now()}
+	b.clock = clock
+
+	keys := &keyRecorder{}
+	b.ad = alarmdecoder.New(keys)
+	b.ad.SetKeyDelay(0)
+
+	topic := "homeassistant/alarm_control_panel/ad2mqtt/notification"
+
+	// The panel disarms.
+	b.handleCommand(b.partitions[0], []byte(`{"action": "DISARM", "code": "1234"}`))
+	err := b.handleMessage(alarmdecoder.Message{Ready: true, UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := client.get(topic); value != "DISARM confirmed by the alarm" {
+		t.Errorf("got notification %q", value)
+	}
+
+	// The panel ignores the arm command.
+	b.handleCommand(b.partitions[0], []byte(`{"action": "ARM_AWAY"}`))
+
+	clock.Advance(5 * time.Second)
+	if value, _ := client.get(topic); value != "DISARM confirmed by the alarm" {
+		t.Errorf("got notification %q before the timeout", value)
+	}
+
+	clock.Advance(5 * time.Second)
+	if value, _ := client.get(topic); !strings.Contains(value, "ARM_AWAY wasn't confirmed") {
+		t.Errorf("got notification %q", value)
+	}
+}
+
+func TestCommandRoundTrip(t *testing.T) {
+	b, client := newTestBridge(nil)
+	b.codeLength = 4
+	b.confirmTimeout = time.Second
+	b.clock = &fakeClock{now: time.Now()}
+
+	panel := decodertest.NewPanel()
+	panel.On("12342", `[01000001100000003A--],,,"ARMED ***AWAY***"`)
+	defer panel.Close()
+
+	b.ad = alarmdecoder.New(panel)
+	b.ad.SetKeyDelay(0)
+
+	b.handleCommand(b.partitions[0], []byte(`{"action": "ARM_AWAY", "code": "1234"}`))
+
+	msg, err := b.ad.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.processMessage(msg)
+
+	if state, _ := client.get("homeassistant/alarm_control_panel/ad2mqtt/state"); state != "armed_away" {
+		t.Errorf("got state %q; wanted %q", state, "armed_away")
+	}
+
+	if value, _ := client.get("homeassistant/alarm_control_panel/ad2mqtt/notification"); value != "ARM_AWAY confirmed by the alarm" {
+		t.Errorf("got notification %q", value)
+	}
+}
+
+func TestRefreshFaults(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{"005": {Name: "door"}, "006": {Name: "window"}})
+	b.refreshWindow = 10 * time.Second
+
+	clock := &fakeClock{now: time.Now()}
+	b.clock = clock
+
+	panel := decodertest.NewPanel()
+	panel.On("*", `[00000001100000003A--],005,[f70000000005001c28020000000000],"FAULT 05 DOOR"`)
+	defer panel.Close()
+
+	b.ad = alarmdecoder.New(panel)
+	b.ad.SetKeyDelay(0)
+
+	// The window got closed while the bridge missed the message.
+	b.lock.Lock()
+	for _, k := range []string{"005", "006"} {
+		err := b.setZoneState(k, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.lock.Unlock()
+
+	b.handleCommand(b.partitions[0], []byte(`{"action": "REFRESH_FAULTS"}`))
+
+	msg, err := b.ad.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.processMessage(msg)
+
+	// Nothing changes before the end of the window.
+	clock.Advance(5 * time.Second)
+	if value, _ := client.get("homeassistant/binary_sensor/window/state"); value != "on" {
+		t.Errorf("got window state %q before the end of the refresh; wanted %q", value, "on")
+	}
+
+	clock.Advance(5 * time.Second)
+	if value, _ := client.get("homeassistant/binary_sensor/door/state"); value != "on" {
+		t.Errorf("got door state %q; wanted %q", value, "on")
+	}
+
+	if value, _ := client.get("homeassistant/binary_sensor/window/state"); value != "off" {
+		t.Errorf("got window state %q; wanted %q", value, "off")
+	}
+}
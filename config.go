@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type zone struct {
+	Name         string `json:"name" yaml:"name"`
+	FriendlyName string `json:"friendly_name" yaml:"friendly_name"`
+	Type         string `json:"type" yaml:"type"`
+	Disabled     bool   `json:"disabled" yaml:"disabled"`
+	RFSerial     string `json:"rf_serial" yaml:"rf_serial"`
+	RFLoop       int    `json:"rf_loop" yaml:"rf_loop"`
+	ClearTimeout int    `json:"clear_timeout" yaml:"clear_timeout"`
+	PayloadOn    string `json:"payload_on" yaml:"payload_on"`
+	PayloadOff   string `json:"payload_off" yaml:"payload_off"`
+	Inverted     bool   `json:"inverted" yaml:"inverted"`
+
+	// Mode is either binary_sensor (default) or trigger to publish faults
+	// as momentary device trigger events instead of a sensor state.
+	Mode string `json:"mode" yaml:"mode"`
+
+	// BlocksArming overrides whether the zone being faulted prevents
+	// arming, which otherwise depends on its type.
+	BlocksArming *bool `json:"blocks_arming" yaml:"blocks_arming"`
+
+	ExpanderAddress int `json:"expander_address" yaml:"expander_address"`
+	ExpanderChannel int `json:"expander_channel" yaml:"expander_channel"`
+
+	// SourceZones are additional panel zones reported through this sensor,
+	// which is faulted as long as any of them is.
+	SourceZones []string `json:"source_zones" yaml:"source_zones"`
+
+	// discovered is set on zones added through auto-discovery rather than
+	// the configuration, which are kept on reload.
+	discovered bool
+}
+
+// isExternal returns whether the zone is reported by a wireless sensor or a
+// zone expander rather than through keypad faults.
+func (z zone) isExternal() bool {
+	return z.RFSerial != "" || z.ExpanderAddress != 0
+}
+
+// blocksArming returns whether the zone being faulted prevents arming, zones
+// of the ignored types (such as motion sensors) being expected to fault.
+func (z zone) blocksArming(ignoredTypes []string) bool {
+	if z.BlocksArming != nil {
+		return *z.BlocksArming
+	}
+
+	return !stringInSlice(z.Type, ignoredTypes)
+}
+
+// isTrigger returns whether the zone is published as a device trigger.
+func (z zone) isTrigger() bool {
+	return z.Mode == "trigger"
+}
+
+// payloadOn returns the payload reported when the zone is on.
+func (z zone) payloadOn() string {
+	if z.PayloadOn == "" {
+		return "on"
+	}
+
+	return z.PayloadOn
+}
+
+// payloadOff returns the payload reported when the zone is off.
+func (z zone) payloadOff() string {
+	if z.PayloadOff == "" {
+		return "off"
+	}
+
+	return z.PayloadOff
+}
+
+// payload returns the payload for a faulted or clear zone, swapping the two
+// for inverted (normally closed) sensors.
+func (z zone) payload(faulted bool) string {
+	if faulted != z.Inverted {
+		return z.payloadOn()
+	}
+
+	return z.payloadOff()
+}
+
+// flags maps command line flags to the environment variable they override.
+// Boolean flags don't take a value, setting the variable to true when passed.
+var flags = []struct {
+	name        string
+	env         string
+	description string
+	boolean     bool
+}{
+	{"config", "CONFIG", "Path to the zone configuration", false},
+	{"serial", "AD_PATH", "Path to the AlarmDecoder serial port (or host:port for ser2sock)", false},
+	{"mqtt-host", "MQTT_HOST", "MQTT broker URL", false},
+	{"mqtt-user", "MQTT_USERNAME", "MQTT username", false},
+	{"mqtt-pass", "MQTT_PASSWORD", "MQTT password", false},
+	{"cleanup", "CLEANUP_ON_SHUTDOWN", "Remove all entities from Home Assistant on shutdown", true},
+}
+
+// flagValues holds the values of the flags set on the command line, keyed by
+// the environment variable they override.
+var flagValues = map[string]string{}
+
+// parseFlags parses the command line flags.
+func parseFlags(args []string) error {
+	fs := flag.NewFlagSet("ad2mqtt", flag.ContinueOnError)
+
+	for _, f := range flags {
+		usage := fmt.Sprintf("%s (defaults to $%s)", f.description, f.env)
+		if f.boolean {
+			fs.Bool(f.name, false, usage)
+		} else {
+			fs.String(f.name, "", usage)
+		}
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	fs.Visit(func(set *flag.Flag) {
+		for _, f := range flags {
+			if f.name == set.Name {
+				// Boolean flags render as "true" or "false".
+				flagValues[f.env] = set.Value.String()
+			}
+		}
+	})
+
+	return nil
+}
+
+// lookupEnv returns the value of a setting, taken from the command line flags
+// if set or from the environment otherwise.
+func lookupEnv(name string) string {
+	value, ok := flagValues[name]
+	if ok {
+		return value
+	}
+
+	return os.Getenv(name)
+}
+
+// lookupSecret returns the value of a setting, read from the file pointed to
+// by its _FILE variant when set, as done for Docker and Kubernetes secrets.
+func lookupSecret(name string) (string, error) {
+	path := lookupEnv(name + "_FILE")
+	if path == "" {
+		return lookupEnv(name), nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read %s_FILE: %w", name, err)
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// getEnv returns the value of the environment variable or the provided
+// default if it's unset or empty.
+func getEnv(name string, defaultValue string) string {
+	value := lookupEnv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	return value
+}
+
+// getEnvList returns the comma separated values of the environment variable
+// or the provided default if it's unset or empty.
+func getEnvList(name string, defaultValue []string) []string {
+	value := lookupEnv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	values := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		values = append(values, entry)
+	}
+
+	return values
+}
+
+// getEnvBool returns the boolean in the environment variable or the provided
+// default if it's unset or empty.
+func getEnvBool(name string, defaultValue bool) (bool, error) {
+	value := lookupEnv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value for %s: %w", name, err)
+	}
+
+	return result, nil
+}
+
+// getEnvInt returns the integer in the environment variable or the provided
+// default if it's unset or empty.
+func getEnvInt(name string, defaultValue int) (int, error) {
+	value := lookupEnv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	result, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value for %s: %w", name, err)
+	}
+
+	return result, nil
+}
+
+// getEnvQoS returns the MQTT QoS level in the environment variable or the
+// provided default if it's unset or empty.
+func getEnvQoS(name string, defaultValue byte) (byte, error) {
+	qos, err := getEnvInt(name, int(defaultValue))
+	if err != nil {
+		return 0, err
+	}
+
+	if qos < 0 || qos > 2 {
+		return 0, fmt.Errorf("Invalid value for %s: QoS must be 0, 1 or 2", name)
+	}
+
+	return byte(qos), nil
+}
+
+// getEnvDuration returns the duration in the environment variable or the
+// provided default if it's unset or empty.
+func getEnvDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := lookupEnv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value for %s: %w", name, err)
+	}
+
+	return duration, nil
+}
+
+// binarySensorDeviceClasses are the device classes supported by Home
+// Assistant for binary sensors.
+var binarySensorDeviceClasses = []string{
+	"battery", "battery_charging", "carbon_monoxide", "cold", "connectivity",
+	"door", "garage_door", "gas", "heat", "light", "lock", "moisture", "motion",
+	"moving", "occupancy", "opening", "plug", "power", "presence", "problem",
+	"running", "safety", "smoke", "sound", "tamper", "update", "vibration",
+	"window",
+}
+
+// validateZones checks the zone configuration, reporting all problems at once.
+func validateZones(zones map[string]zone) error {
+	keys := make([]string, 0, len(zones))
+	for k := range zones {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	problems := []string{}
+	names := map[string]string{}
+	sources := map[string]string{}
+	for _, k := range keys {
+		zone := zones[k]
+		if zone.Disabled {
+			continue
+		}
+
+		if zone.Name == "" {
+			problems = append(problems, fmt.Sprintf("zone %q is missing a name", k))
+		} else if other, ok := names[zone.Name]; ok {
+			problems = append(problems, fmt.Sprintf("zone %q uses the same name %q as zone %q", k, zone.Name, other))
+		} else {
+			names[zone.Name] = k
+		}
+
+		if zone.Type != "" && !stringInSlice(zone.Type, binarySensorDeviceClasses) {
+			problems = append(problems, fmt.Sprintf("zone %q has invalid type %q", k, zone.Type))
+		}
+
+		if zone.Mode != "" && zone.Mode != "binary_sensor" && zone.Mode != "trigger" {
+			problems = append(problems, fmt.Sprintf("zone %q has invalid mode %q", k, zone.Mode))
+		}
+
+		for _, source := range zone.SourceZones {
+			other, ok := zones[source]
+			if ok && !other.Disabled {
+				problems = append(problems, fmt.Sprintf("zone %q lists source zone %q which is configured on its own", k, source))
+			} else if owner, ok := sources[source]; ok {
+				problems = append(problems, fmt.Sprintf("zone %q lists source zone %q already used by zone %q", k, source, owner))
+			} else {
+				sources[source] = k
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid zone config: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// stringInSlice returns whether the string is in the slice.
+func stringInSlice(key string, list []string) bool {
+	for _, entry := range list {
+		if entry == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadZones loads the zone configuration, either as YAML or JSON depending
+// on the file extension.
+func loadZones(path string) (map[string]zone, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load the config: %w", err)
+	}
+
+	var zones map[string]zone
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &zones)
+	default:
+		err = json.Unmarshal(content, &zones)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal the config: %w", err)
+	}
+
+	return zones, nil
+}
+
+// reloadZones re-reads the zone configuration, publishing the discovery
+// configuration of new zones and removing that of deleted zones.
+func (b *bridge) reloadZones(path string) error {
+	zones, err := loadZones(path)
+	if err != nil {
+		return err
+	}
+
+	err = validateZones(zones)
+	if err != nil {
+		return err
+	}
+
+	if zones == nil {
+		zones = map[string]zone{}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Keep the auto-discovered zones which the configuration doesn't define.
+	for k, oldZone := range b.zones {
+		_, ok := zones[k]
+		if oldZone.discovered && !ok {
+			zones[k] = oldZone
+		}
+	}
+
+	// Remove zones which were deleted, disabled or renamed.
+	flapping := false
+	for k, oldZone := range b.zones {
+		if oldZone.Disabled || oldZone.Name == "" {
+			continue
+		}
+
+		newZone, ok := zones[k]
+		if ok && !newZone.Disabled && newZone.Name == oldZone.Name && newZone.isTrigger() == oldZone.isTrigger() {
+			continue
+		}
+
+		for _, suffix := range []string{"config", "state", "attributes"} {
+			err := b.publishRetained(b.zoneTopic(oldZone, suffix), "")
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, source := range append([]string{k}, oldZone.SourceZones...) {
+			delete(b.zoneState, source)
+			delete(b.zoneFaultedAt, source)
+			delete(b.faultCycle, source)
+			delete(b.troubleZones, source)
+		}
+
+		delete(b.zoneTriggeredAt, k)
+		delete(b.zoneFlips, k)
+
+		timer, ok := b.flappingZones[k]
+		if ok {
+			timer.Stop()
+			delete(b.flappingZones, k)
+			flapping = true
+		}
+
+		logInfof("[alarm] Removed zone %q", oldZone.Name)
+	}
+
+	// Publish new or modified zones.
+	for k, newZone := range zones {
+		if newZone.Disabled || newZone.Name == "" {
+			continue
+		}
+
+		oldZone, ok := b.zones[k]
+		if ok && reflect.DeepEqual(oldZone, newZone) {
+			continue
+		}
+
+		err := b.publishZoneConfig(newZone)
+		if err != nil {
+			return err
+		}
+
+		err = b.publishZoneState(k, newZone)
+		if err != nil {
+			return err
+		}
+
+		logInfof("[alarm] Loaded zone %q", newZone.Name)
+	}
+
+	b.zones = zones
+
+	if flapping {
+		return b.updateFlappingSensor()
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+func TestLoadZones(t *testing.T) {
+	dir := t.TempDir()
+
+	jsonPath := filepath.Join(dir, "zones.json")
+	err := os.WriteFile(jsonPath, []byte(`{
+    "005": {
+        "name": "front_door",
+        "friendly_name": "Front door",
+        "type": "door"
+    },
+    "006": {
+        "name": "motion",
+        "friendly_name": "Motion",
+        "type": "motion",
+        "disabled": true
+    },
+    "020": {
+        "name": "garage",
+        "friendly_name": "Garage",
+        "type": "garage_door",
+        "rf_serial": "0123456",
+        "rf_loop": 2
+    }
+}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yamlPath := filepath.Join(dir, "zones.yaml")
+	err = os.WriteFile(yamlPath, []byte(`"005":
+  name: front_door
+  friendly_name: Front door
+  type: door
+"006":
+  name: motion
+  friendly_name: Motion
+  type: motion
+  disabled: true
+"020":
+  name: garage
+  friendly_name: Garage
+  type: garage_door
+  rf_serial: "0123456"
+  rf_loop: 2
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jsonZones, err := loadZones(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yamlZones, err := loadZones(yamlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jsonZones) != 3 {
+		t.Errorf("expected 3 zones, got %d", len(jsonZones))
+	}
+
+	if !reflect.DeepEqual(jsonZones, yamlZones) {
+		t.Errorf("JSON config %+v doesn't match YAML config %+v", jsonZones, yamlZones)
+	}
+}
+
+func TestReloadZones(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{
+		"005": {Name: "door"},
+		"006": {Name: "window"},
+		"007": {Name: "garage"},
+	})
+
+	b.autoDiscoverZones = true
+
+	for _, z := range []string{"005", "006", "009"} {
+		err := b.handleMessage(alarmdecoder.Message{Zone: z, KeypadMessage: "FAULT " + z, UnparsedMessage: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b.zoneFlips["006"] = []time.Time{time.Now()}
+
+	// The window gets renamed, the garage deleted and the shed added.
+	path := filepath.Join(t.TempDir(), "zones.json")
+	err := os.WriteFile(path, []byte(`{
+    "005": {"name": "door"},
+    "006": {"name": "back_window"},
+    "008": {"name": "shed"}
+}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.reloadZones(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, removed := range map[string]bool{"door": false, "ad2mqtt_zone_009": false, "window": true, "garage": true} {
+		config, ok := client.published["homeassistant/binary_sensor/"+name+"/config"]
+		if removed != (ok && config == "") {
+			t.Errorf("zone %q had its config set to %q", name, config)
+		}
+	}
+
+	for _, name := range []string{"back_window", "shed"} {
+		if client.published["homeassistant/binary_sensor/"+name+"/config"] == "" {
+			t.Errorf("new zone %q has no config", name)
+		}
+	}
+
+	if len(b.zones) != 4 || !b.zones["009"].discovered {
+		t.Errorf("auto-discovered zone wasn't kept: %+v", b.zones)
+	}
+
+	if !b.zoneState["005"] || !b.zoneState["009"] {
+		t.Errorf("state of kept zones was lost: %v", b.zoneState)
+	}
+
+	if b.zoneState["006"] || b.faultCycle["006"] || b.zoneFlips["006"] != nil {
+		t.Errorf("state of renamed zone wasn't cleared")
+	}
+
+	value := client.published["homeassistant/binary_sensor/back_window/state"]
+	if value != "off" {
+		t.Errorf("renamed zone state is %q, expected off", value)
+	}
+}
+
+func TestValidateZones(t *testing.T) {
+	err := validateZones(map[string]zone{
+		"005": {Name: "front_door", Type: "door"},
+		"006": {Name: "motion", Type: "motion"},
+		"007": {Type: "not-a-class", Disabled: true},
+	})
+	if err != nil {
+		t.Errorf("valid config failed validation: %v", err)
+	}
+
+	err = validateZones(map[string]zone{
+		"005": {Name: "front_door", Type: "door"},
+		"006": {Name: "front_door", Type: "motion"},
+		"007": {Type: "window"},
+		"008": {Name: "back_door", Type: "doors"},
+		"009": {Name: "garage", SourceZones: []string{"005", "010"}},
+		"011": {Name: "shed", SourceZones: []string{"010"}},
+	})
+	if err == nil {
+		t.Fatal("invalid config passed validation")
+	}
+
+	for _, problem := range []string{`zone "006" uses the same name`, `zone "007" is missing a name`, `zone "008" has invalid type "doors"`, `zone "009" lists source zone "005" which is configured on its own`, `zone "011" lists source zone "010" already used by zone "009"`} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error %q doesn't mention %q", err, problem)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	defer func() { flagValues = map[string]string{} }()
+
+	t.Setenv("AD_PATH", "/dev/ttyUSB0")
+	t.Setenv("MQTT_HOST", "tcp://broker:1883")
+
+	err := parseFlags([]string{"-serial", "/dev/ttyAMA0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lookupEnv("AD_PATH") != "/dev/ttyAMA0" {
+		t.Errorf("flag didn't take precedence over the environment, got %q", lookupEnv("AD_PATH"))
+	}
+
+	if lookupEnv("MQTT_HOST") != "tcp://broker:1883" {
+		t.Errorf("environment wasn't used when the flag is unset, got %q", lookupEnv("MQTT_HOST"))
+	}
+
+	if getEnv("DEVICE_ID", "ad2mqtt") != "ad2mqtt" {
+		t.Errorf("default wasn't used when both flag and environment are unset")
+	}
+
+	// Boolean flags don't take a value.
+	err = parseFlags([]string{"-cleanup", "-config", "zones.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup, err := getEnvBool("CLEANUP_ON_SHUTDOWN", false)
+	if err != nil || !cleanup {
+		t.Errorf("bare boolean flag wasn't set, got %v (%v)", cleanup, err)
+	}
+
+	if lookupEnv("CONFIG") != "zones.json" {
+		t.Errorf("flag following a boolean flag wasn't parsed, got %q", lookupEnv("CONFIG"))
+	}
+
+	err = parseFlags([]string{"-cleanup=false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lookupEnv("CLEANUP_ON_SHUTDOWN") != "false" {
+		t.Errorf("boolean flag wasn't disabled, got %q", lookupEnv("CLEANUP_ON_SHUTDOWN"))
+	}
+}
+
+func TestLookupSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	err := os.WriteFile(path, []byte("s3cret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("MQTT_PASSWORD", "plain")
+
+	value, err := lookupSecret("MQTT_PASSWORD")
+	if err != nil || value != "plain" {
+		t.Errorf("got %q (%v); wanted %q", value, err, "plain")
+	}
+
+	// The file takes precedence.
+	t.Setenv("MQTT_PASSWORD_FILE", path)
+
+	value, err = lookupSecret("MQTT_PASSWORD")
+	if err != nil || value != "s3cret" {
+		t.Errorf("got %q (%v); wanted %q", value, err, "s3cret")
+	}
+
+	t.Setenv("MQTT_PASSWORD_FILE", filepath.Join(t.TempDir(), "missing"))
+
+	_, err = lookupSecret("MQTT_PASSWORD")
+	if err == nil {
+		t.Errorf("expected a missing secret file to fail")
+	}
+}
+
+func TestGetEnvQoS(t *testing.T) {
+	qos, err := getEnvQoS("MQTT_QOS", 0)
+	if err != nil || qos != 0 {
+		t.Errorf("got QoS %d (%v); wanted the default", qos, err)
+	}
+
+	t.Setenv("MQTT_QOS", "2")
+	qos, err = getEnvQoS("MQTT_QOS", 0)
+	if err != nil || qos != 2 {
+		t.Errorf("got QoS %d (%v); wanted %d", qos, err, 2)
+	}
+
+	t.Setenv("MQTT_QOS", "3")
+	_, err = getEnvQoS("MQTT_QOS", 0)
+	if err == nil {
+		t.Errorf("expected QoS 3 to be rejected")
+	}
+}
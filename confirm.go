@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+// expectedStates are the alarm states confirming that a command went through.
+var expectedStates = map[string][]string{
+	"ARM_HOME":  {"arming", "armed_home"},
+	"ARM_AWAY":  {"arming", "armed_away"},
+	"ARM_NIGHT": {"arming", "armed_night"},
+	"DISARM":    {"disarmed"},
+	"CLEAR":     {"disarmed"},
+}
+
+// pendingCommand is a command waiting for the panel to reach the expected state.
+type pendingCommand struct {
+	action string
+	timer  alarmdecoder.Timer
+}
+
+// expectState waits for the partition to reach the state expected after the
+// command, reporting a failure if it doesn't within the confirmation timeout.
+// A zero timeout disables confirmations.
+func (b *bridge) expectState(p *partition, action string) {
+	if b.confirmTimeout <= 0 || expectedStates[action] == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if p.expected != nil {
+		p.expected.timer.Stop()
+	}
+
+	cmd := &pendingCommand{action: action}
+	cmd.timer = b.clock.AfterFunc(b.confirmTimeout, func() {
+		b.lock.Lock()
+		if p.expected != cmd {
+			b.lock.Unlock()
+			return
+		}
+
+		p.expected = nil
+		b.lock.Unlock()
+
+		b.notify(p, fmt.Sprintf("%s wasn't confirmed by the alarm within %s", action, b.confirmTimeout))
+	})
+
+	p.expected = cmd
+}
+
+// confirmState checks whether the partition reached the state expected by a
+// pending command. The caller must hold the lock.
+func (b *bridge) confirmState(p *partition, state string) {
+	if p.expected == nil || !stringInSlice(state, expectedStates[p.expected.action]) {
+		return
+	}
+
+	p.expected.timer.Stop()
+
+	message := fmt.Sprintf("%s confirmed by the alarm", p.expected.action)
+	logInfof("[mqtt] %s", message)
+	b.publishNotification(p, message)
+
+	p.expected = nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+// debugState is the internal state of the bridge, published on request to
+// help with troubleshooting remote installs.
+type debugState struct {
+	UnparsedMessage string               `json:"unparsed_message"`
+	Message         alarmdecoder.Message `json:"message"`
+	Mode            string               `json:"mode"`
+	AlarmState      map[int]string       `json:"alarm_state"`
+	ZoneState       map[string]bool      `json:"zone_state"`
+}
+
+// parseErrorReport is a line which the decoder failed to parse.
+type parseErrorReport struct {
+	Line  string `json:"line"`
+	Field string `json:"field,omitempty"`
+	Error string `json:"error"`
+}
+
+// publishParseError publishes a line which failed to parse to the
+// parse_errors topic, if enabled, so they can be collected to improve the
+// parser.
+func (b *bridge) publishParseError(err error) {
+	if !b.publishParseErrors {
+		return
+	}
+
+	report := parseErrorReport{Error: err.Error()}
+
+	var parseErr *alarmdecoder.ParseError
+	if errors.As(err, &parseErr) {
+		report.Line = parseErr.Line
+		report.Field = parseErr.Field
+		report.Error = parseErr.Err.Error()
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		logErrorf("[mqtt] Failed to encode the parse error: %v", err)
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	err = b.publishMessage(b.panelTopic("parse_errors"), false, string(data))
+	if err != nil {
+		logErrorf("[mqtt] Failed to publish the parse error: %v", err)
+	}
+}
+
+// publishDebug publishes the last keypad message along with the alarm and
+// zone states to the debug topic. The caller must hold the lock.
+func (b *bridge) publishDebug() error {
+	state := debugState{
+		UnparsedMessage: b.lastKeypad.UnparsedMessage,
+		Message:         b.lastKeypad,
+		Mode:            b.mode,
+		AlarmState:      map[int]string{},
+		ZoneState:       b.zoneState,
+	}
+
+	for _, p := range b.partitions {
+		state.AlarmState[p.id] = p.alarmState
+	}
+
+	return b.publishJSON(b.panelTopic("debug"), state)
+}
@@ -0,0 +1,41 @@
+package alarmdecoder
+
+import (
+	"time"
+)
+
+// Clock provides the current time and timers, allowing tests to control time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel receiving the time once the duration elapsed.
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f in its own goroutine once the duration elapsed.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock, as implemented by time.Timer.
+type Timer interface {
+	// Stop prevents the timer from firing, returning whether it was active.
+	Stop() bool
+	// Reset changes the timer to fire after the duration, returning
+	// whether it was active.
+	Reset(d time.Duration) bool
+}
+
+// RealClock is the Clock using the system time.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
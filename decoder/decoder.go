@@ -2,24 +2,113 @@ package alarmdecoder
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
-// ParseMessage parses a message from AD2PI.
+// ParseError is returned when a message from the AlarmDecoder is malformed.
+type ParseError struct {
+	// Field is the part of the message which failed to parse.
+	Field string
+	// Line is the original unparsed message.
+	Line string
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns the error message.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid %s in %q: %v", e.Field, e.Line, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseMessage parses a message from AD2PI. Errors are of type *ParseError.
 func ParseMessage(s string) (Message, error) {
+	var field string
+	var parse func(string) (Message, error)
+
+	if strings.HasPrefix(s, "!LRR:") {
+		field, parse = "LRR message", parseLRR
+	} else if strings.HasPrefix(s, "!RFX:") {
+		field, parse = "RFX message", parseRFX
+	} else if strings.HasPrefix(s, "!VER:") {
+		field, parse = "VER message", parseVersion
+	} else if strings.HasPrefix(s, "!EXP:") {
+		field, parse = "EXP message", parseExpander
+	} else if strings.HasPrefix(s, "!REL:") {
+		field, parse = "REL message", parseRelay
+	} else if strings.HasPrefix(s, "!AUI:") {
+		field, parse = "AUI message", parseAUI
+	} else {
+		return parseKeypad(s)
+	}
+
+	m, err := parse(s)
+	if err != nil {
+		return Message{}, &ParseError{Field: field, Line: s, Err: err}
+	}
+
+	return m, nil
+}
+
+// parseExpander parses a zone expander message.
+//
+// Format: !EXP:<address>,<channel>,<state>
+func parseExpander(s string) (Message, error) {
+	address, channel, state, err := parseAddressChannelState(strings.TrimPrefix(s, "!EXP:"))
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		UnparsedMessage: s,
+		Expander:        &ExpanderMessage{Address: address, Channel: channel, State: state},
+	}, nil
+}
+
+// parseRelay parses a relay module message.
+//
+// Format: !REL:<address>,<channel>,<state>
+func parseRelay(s string) (Message, error) {
+	address, channel, state, err := parseAddressChannelState(strings.TrimPrefix(s, "!REL:"))
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		UnparsedMessage: s,
+		Relay:           &RelayMessage{Address: address, Channel: channel, State: state},
+	}, nil
+}
+
+// parseKeypad parses a keypad message.
+func parseKeypad(s string) (Message, error) {
 	m := Message{
 		UnparsedMessage: s,
 	}
-	parts := strings.Split(s, ",")
+	// The keypad message may itself contain commas.
+	parts := strings.SplitN(s, ",", 4)
 	if len(parts) != 4 {
-		return Message{}, errors.Errorf("expected 4 parts got: %#v", parts)
+		return Message{}, &ParseError{Field: "message", Line: s, Err: errors.Errorf("expected 4 parts got %d", len(parts))}
 	}
 
 	bits := parts[0]
+	if len(bits) < 19 {
+		return Message{}, &ParseError{Field: "bit field", Line: s, Err: errors.Errorf("expected at least 19 characters got: %q", bits)}
+	}
+
 	m.Ready = bits[1] == '1'
 	m.ArmedAway = bits[2] == '1'
 	m.ArmedHome = bits[3] == '1'
@@ -28,7 +117,7 @@ func ParseMessage(s string) (Message, error) {
 	var err error
 	m.Beeps, err = strconv.Atoi(bits[6:7])
 	if err != nil {
-		return Message{}, err
+		return Message{}, &ParseError{Field: "beeps", Line: s, Err: err}
 	}
 	m.ZoneBypassed = bits[7] == '1'
 	m.ACPower = bits[8] == '1'
@@ -40,19 +129,333 @@ func ParseMessage(s string) (Message, error) {
 	m.Fire = bits[14] == '1'
 	m.SystemIssue = bits[15] == '1'
 	m.PerimeterOnly = bits[16] == '1'
+	systemSpecific, err := strconv.ParseUint(bits[17:18], 16, 8)
+	if err != nil {
+		return Message{}, &ParseError{Field: "system specific bits", Line: s, Err: err}
+	}
+	m.SystemSpecific = byte(systemSpecific)
 	m.Mode = bits[18:19]
 
 	m.Zone = parts[1]
 	m.RawData = parts[2]
+	m.KeypadAddressMask, err = parseAddressMask(m.RawData)
+	if err != nil {
+		return Message{}, &ParseError{Field: "raw data", Line: s, Err: err}
+	}
+
 	msg := parts[3]
+	if len(msg) < 2 {
+		return Message{}, &ParseError{Field: "keypad message", Line: s, Err: errors.Errorf("expected quoted message got: %q", msg)}
+	}
 	m.KeypadMessage = strings.TrimSpace(msg[1 : len(msg)-1])
+	m.ZoneBusFailure = m.SystemIssue && isBusFailure(m.Zone, m.KeypadMessage)
 	return m, nil
 }
 
+// isBusFailure returns whether a zone code reported along with a system issue
+// is for an ECP bus failure. Those show as a CHECK of a zone other than the
+// base10 reading of the code, the code then being base16.
+func isBusFailure(code string, text string) bool {
+	fields := strings.Fields(text)
+	if len(fields) < 2 || fields[0] != "CHECK" {
+		return false
+	}
+
+	shown, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return false
+	}
+
+	zone, err := strconv.Atoi(code)
+	return err != nil || zone != shown
+}
+
+// parseAddressMask extracts the keypad address mask from the raw data. Messages
+// without raw data have an empty mask.
+func parseAddressMask(raw string) (uint32, error) {
+	raw = strings.TrimSuffix(strings.TrimPrefix(raw, "["), "]")
+	if raw == "" {
+		return 0, nil
+	}
+
+	if len(raw) < 10 {
+		return 0, errors.Errorf("expected raw data of at least 10 characters got: %q", raw)
+	}
+
+	mask, err := strconv.ParseUint(raw[2:10], 16, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid keypad address mask %q", raw[2:10])
+	}
+
+	return uint32(mask), nil
+}
+
+// parseLRR parses a Long Range Radio message.
+//
+// Format: !LRR:<event data>,<partition>,<event type>[,<report code>]
+func parseLRR(s string) (Message, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "!LRR:"), ",")
+	if len(parts) < 3 {
+		return Message{}, errors.Errorf("expected at least 3 LRR parts got: %#v", parts)
+	}
+
+	partition, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Message{}, errors.Wrapf(err, "invalid LRR partition %q", parts[1])
+	}
+
+	lrr := LRRMessage{
+		EventData: parts[0],
+		Partition: partition,
+		EventType: parts[2],
+	}
+
+	// Contact ID events are formatted as CID_QEEE.
+	if strings.HasPrefix(lrr.EventType, "CID_") {
+		cid := strings.TrimPrefix(lrr.EventType, "CID_")
+		if len(cid) != 4 {
+			return Message{}, errors.Errorf("invalid LRR contact ID event %q", lrr.EventType)
+		}
+
+		lrr.Qualifier, err = strconv.Atoi(cid[0:1])
+		if err != nil {
+			return Message{}, errors.Wrapf(err, "invalid LRR contact ID qualifier %q", cid[0:1])
+		}
+
+		lrr.EventCode = cid[1:]
+	}
+
+	if len(parts) > 3 {
+		lrr.ReportCode = parts[3]
+	}
+
+	return Message{
+		UnparsedMessage: s,
+		LRR:             &lrr,
+	}, nil
+}
+
+// LRRMessage contains the details of a Long Range Radio message.
+type LRRMessage struct {
+	// Event data, usually the user or zone number associated with the event.
+	EventData string
+	// Partition the event applies to.
+	Partition int
+	// Event type as reported by the panel (e.g. CID_1130).
+	EventType string
+	// Contact ID qualifier (1 for a new event, 3 for a restore, 6 for a previously reported event).
+	Qualifier int
+	// Contact ID event code (e.g. 130 for a burglary alarm).
+	EventCode string
+	// Report code, only present with newer firmware.
+	ReportCode string
+}
+
+// parseRFX parses a wireless sensor message.
+//
+// Format: !RFX:<serial number>,<status>
+func parseRFX(s string) (Message, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "!RFX:"), ",")
+	if len(parts) != 2 {
+		return Message{}, errors.Errorf("expected 2 RFX parts got: %#v", parts)
+	}
+
+	status, err := strconv.ParseUint(parts[1], 16, 8)
+	if err != nil {
+		return Message{}, errors.Wrapf(err, "invalid RFX status %q", parts[1])
+	}
+
+	return Message{
+		UnparsedMessage: s,
+		RFX: &RFXMessage{
+			SerialNumber: parts[0],
+			Loop1:        status&0x80 != 0,
+			Loop2:        status&0x20 != 0,
+			Loop3:        status&0x10 != 0,
+			Loop4:        status&0x40 != 0,
+			LowBattery:   status&0x02 != 0,
+			Supervision:  status&0x04 != 0,
+		},
+	}, nil
+}
+
+// RFXMessage contains the state of a wireless sensor.
+type RFXMessage struct {
+	// Serial number of the sensor.
+	SerialNumber string
+
+	// Status byte
+
+	// 2 Indicates that the battery is low
+	LowBattery bool
+	// 3 Indicates a supervision message
+	Supervision bool
+	// 5 Indicates that loop 3 is faulted
+	Loop3 bool
+	// 6 Indicates that loop 2 is faulted
+	Loop2 bool
+	// 7 Indicates that loop 4 is faulted
+	Loop4 bool
+	// 8 Indicates that loop 1 is faulted
+	Loop1 bool
+}
+
+// Loop returns whether the given loop (1-4) is faulted.
+func (rfx *RFXMessage) Loop(n int) bool {
+	switch n {
+	case 1:
+		return rfx.Loop1
+	case 2:
+		return rfx.Loop2
+	case 3:
+		return rfx.Loop3
+	case 4:
+		return rfx.Loop4
+	}
+
+	return false
+}
+
+// parseVersion parses the version information of the AlarmDecoder.
+//
+// Format: !VER:<serial number>,<firmware version>,<capabilities separated by ;>[,<config bits>]
+func parseVersion(s string) (Message, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "!VER:"), ",")
+	if len(parts) != 3 && len(parts) != 4 {
+		return Message{}, errors.Errorf("expected 3 or 4 VER parts got: %#v", parts)
+	}
+
+	_, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return Message{}, errors.Wrapf(err, "invalid VER serial number %q", parts[0])
+	}
+
+	version := VersionMessage{
+		SerialNumber: parts[0],
+		Firmware:     parts[1],
+		Capabilities: []string{},
+	}
+
+	for _, capability := range strings.Split(parts[2], ";") {
+		if capability != "" {
+			version.Capabilities = append(version.Capabilities, capability)
+		}
+	}
+
+	if len(parts) == 4 {
+		bits, err := strconv.ParseUint(parts[3], 16, 32)
+		if err != nil {
+			return Message{}, errors.Wrapf(err, "invalid VER config bits %q", parts[3])
+		}
+
+		version.ConfigBits = uint32(bits)
+	}
+
+	return Message{
+		UnparsedMessage: s,
+		Version:         &version,
+	}, nil
+}
+
+// parseAUI parses an Ademco AUI message. Its payload isn't decoded yet.
+//
+// Format: !AUI:<data>
+func parseAUI(s string) (Message, error) {
+	return Message{
+		UnparsedMessage: s,
+		AUI: &AUIMessage{
+			Data: strings.TrimPrefix(s, "!AUI:"),
+		},
+	}, nil
+}
+
+// AUIMessage is a message sent by newer firmware for the Ademco AUI
+// (Advanced User Interface) devices, carrying richer panel state.
+type AUIMessage struct {
+	// Raw payload of the message, after the !AUI: prefix.
+	Data string
+}
+
+// VersionMessage contains the version information of the AlarmDecoder.
+type VersionMessage struct {
+	// Serial number of the AlarmDecoder, in hex.
+	SerialNumber string
+	// Firmware version (e.g. V2.2a.8.8).
+	Firmware string
+	// Capabilities supported by the firmware (e.g. RFX for wireless sensors).
+	Capabilities []string
+	// Configuration bits (CONFIGBITS), zero if not reported.
+	ConfigBits uint32
+}
+
+// HasCapability returns whether the firmware reports the given capability.
+func (v *VersionMessage) HasCapability(capability string) bool {
+	for _, entry := range v.Capabilities {
+		if entry == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseAddressChannelState parses the payload shared by zone expander and
+// relay messages.
+//
+// Format: <address>,<channel>,<state>
+func parseAddressChannelState(s string) (int, int, bool, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return 0, 0, false, errors.Errorf("expected 3 parts got: %#v", parts)
+	}
+
+	address, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false, errors.Wrapf(err, "invalid address %q", parts[0])
+	}
+
+	channel, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false, errors.Wrapf(err, "invalid channel %q", parts[1])
+	}
+
+	state, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return 0, 0, false, errors.Wrapf(err, "invalid state %q", parts[2])
+	}
+
+	return address, channel, state != 0, nil
+}
+
+// ExpanderMessage contains the state of a zone on a zone expander board.
+type ExpanderMessage struct {
+	// Address of the expander board.
+	Address int
+	// Channel (zone) on the expander board.
+	Channel int
+	// Indicates that the zone is faulted.
+	State bool
+}
+
+// RelayMessage contains the state of a relay on a relay module.
+type RelayMessage struct {
+	// Address of the relay module.
+	Address int
+	// Channel (relay) on the relay module.
+	Channel int
+	// Indicates that the relay is closed.
+	State bool
+}
+
 // Message contains
 type Message struct {
 	UnparsedMessage string
 
+	// ReceivedAt is when the message was read from the stream.
+	ReceivedAt time.Time
+	// Seq is the position of the message in the stream, starting at 1.
+	Seq uint64
+
 	// Bit field
 
 	// The bit field present on the keypad messages is where you're going to get
@@ -92,6 +495,7 @@ type Message struct {
 	// 16 Indicates that the panel is only watching the perimeter (ARMED STAY/NIGHT)
 	PerimeterOnly bool
 	// 17 System specific bits. 4 bits packed into a HEX Nibble [0-9,A-F]
+	SystemSpecific byte
 	// 18 Ademco or DSC Mode A or D
 	Mode string
 	// 19 Unused
@@ -105,6 +509,11 @@ type Message struct {
 	// where this may be base16, such as ECP bus failures.
 	Zone string
 
+	// ZoneBusFailure is set when the zone code is base16, as reported during
+	// ECP bus failures along with a CHECK message and the system issue flag.
+	// Use ZoneNumber to decode either form.
+	ZoneBusFailure bool
+
 	// Raw data
 
 	// This is the binary data associated with the message. It includes all of the
@@ -116,41 +525,384 @@ type Message struct {
 	// indicate which keypads this message is intended for.
 	RawData string
 
+	// Keypad address mask parsed from the raw data.
+	KeypadAddressMask uint32
+
 	// Alphanumeric Keypad Message
 
 	// This section is the data that would be displayed on your keypad's screen.
 	KeypadMessage string
+
+	// Long Range Radio message, only set for !LRR messages in which case the
+	// keypad fields above are left empty.
+	LRR *LRRMessage
+
+	// Wireless sensor message, only set for !RFX messages.
+	RFX *RFXMessage
+
+	// Zone expander message, only set for !EXP messages.
+	Expander *ExpanderMessage
+
+	// Relay module message, only set for !REL messages.
+	Relay *RelayMessage
+
+	// AlarmDecoder version, only set for !VER messages.
+	Version *VersionMessage
+
+	// Ademco AUI message, only set for !AUI messages.
+	AUI *AUIMessage
 }
 
 // AlarmDecoder allows for interacting with an AlarmDecoder device over serial.
 type AlarmDecoder struct {
 	rw      io.ReadWriter
 	scanner *bufio.Scanner
+
+	// discarding is set while skipping the rest of a line which was too
+	// long and dropped is set once it's been skipped.
+	discarding bool
+	dropped    bool
+
+	// pending holds the result of a read which outlived a cancelled context.
+	pending chan readResult
+
+	// seq is the sequence number of the last message read.
+	seq uint64
+
+	// clock provides the time of received messages and the key delay.
+	clock Clock
+
+	// writeLock serializes writes so key sequences don't get interleaved.
+	writeLock sync.Mutex
+	keyDelay  time.Duration
+
+	// writesDisabled refuses all writes, for monitoring only installs.
+	writesDisabled bool
+
+	// mode is the panel mode reported by the last keypad message, unless
+	// modeForced is set.
+	modeLock   sync.Mutex
+	mode       string
+	modeForced bool
 }
 
-// New returns a new AlarmDecoder. Context can be cancelled to terminate the
-// background goroutine.
+type readResult struct {
+	msg Message
+	err error
+
+	// closed is set when the error ended the stream.
+	closed bool
+}
+
+// MaxLineLength is the longest line read from the stream, longer lines get
+// skipped.
+const MaxLineLength = 1024 * 1024
+
+// ErrLineTooLong is returned when a line longer than MaxLineLength was skipped.
+var ErrLineTooLong = errors.New("line too long")
+
+// ErrClosed is returned once the stream has been closed.
+var ErrClosed = errors.New("connection closed")
+
+// ErrReadOnly is returned when writing to a read-only AlarmDecoder.
+var ErrReadOnly = errors.New("read-only mode")
+
+// New returns a new AlarmDecoder.
 func New(rw io.ReadWriter) *AlarmDecoder {
-	return &AlarmDecoder{
-		rw:      rw,
-		scanner: bufio.NewScanner(rw),
+	ad := &AlarmDecoder{
+		rw:       rw,
+		scanner:  bufio.NewScanner(rw),
+		keyDelay: DefaultKeyDelay,
+		clock:    RealClock,
+	}
+
+	ad.scanner.Buffer(make([]byte, 4096), MaxLineLength)
+	ad.scanner.Split(ad.scanLines)
+
+	return ad
+}
+
+// readOnly adapts a reader for decoding, refusing any write.
+type readOnly struct {
+	io.Reader
+}
+
+// Write always fails.
+func (readOnly) Write(p []byte) (int, error) {
+	return 0, errors.New("read-only stream")
+}
+
+// DecodeAll reads a finite stream to the end, returning all parsed messages
+// along with the errors of the lines which couldn't be parsed.
+func DecodeAll(r io.Reader) ([]Message, []error) {
+	ad := New(readOnly{r})
+
+	msgs := []Message{}
+	errs := []error{}
+	for {
+		res := ad.read()
+		if res.closed {
+			if res.err != ErrClosed {
+				errs = append(errs, res.err)
+			}
+
+			return msgs, errs
+		}
+
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+
+		msgs = append(msgs, res.msg)
+	}
+}
+
+// scanLines splits the stream into lines terminated by \n, \r\n or a bare
+// \r. Lines which don't fit in the buffer get skipped rather than failing
+// like bufio.ScanLines. A \r\n results in an extra empty line which gets
+// ignored by read.
+func (ad *AlarmDecoder) scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	i := bytes.IndexAny(data, "\r\n")
+
+	if !ad.discarding {
+		if i >= 0 {
+			return i + 1, data[:i], nil
+		}
+
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+
+		if len(data) < MaxLineLength {
+			// Request more data.
+			return 0, nil, nil
+		}
+
+		// The buffer is full without a line ending, skip until the next one.
+		ad.discarding = true
+	}
+
+	if i < 0 {
+		return len(data), nil, nil
 	}
+
+	ad.discarding = false
+	ad.dropped = true
+
+	// Return an empty token so Scan reports the dropped line.
+	return i + 1, []byte{}, nil
+}
+
+// DefaultKeyDelay is the default delay between keypresses sent by SendKeys.
+const DefaultKeyDelay = 100 * time.Millisecond
+
+// SetKeyDelay sets the delay between keypresses sent by SendKeys as some
+// panels drop keys sent too quickly.
+func (ad *AlarmDecoder) SetKeyDelay(delay time.Duration) {
+	ad.writeLock.Lock()
+	defer ad.writeLock.Unlock()
+
+	ad.keyDelay = delay
+}
+
+// SetReadOnly makes all writes fail with ErrReadOnly without sending
+// anything to the alarm.
+func (ad *AlarmDecoder) SetReadOnly(enabled bool) {
+	ad.writeLock.Lock()
+	defer ad.writeLock.Unlock()
+
+	ad.writesDisabled = enabled
+}
+
+// SetClock sets the clock used to timestamp messages and delay keypresses.
+// It must be called before reading from or writing to the AlarmDecoder.
+func (ad *AlarmDecoder) SetClock(clock Clock) {
+	ad.writeLock.Lock()
+	defer ad.writeLock.Unlock()
+
+	ad.clock = clock
 }
 
 // Read returns a single message from the stream.
 func (ad *AlarmDecoder) Read() (Message, error) {
+	return ad.ReadContext(context.Background())
+}
+
+// ReadContext returns a single message from the stream or the context's error
+// if it gets cancelled first. A message arriving after cancellation isn't
+// lost and is returned by the next call. ReadContext must not be called
+// concurrently.
+func (ad *AlarmDecoder) ReadContext(ctx context.Context) (Message, error) {
+	res, err := ad.readContext(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return res.msg, res.err
+}
+
+// readContext returns the result of a single read from the stream or the
+// context's error if it gets cancelled first.
+func (ad *AlarmDecoder) readContext(ctx context.Context) (readResult, error) {
+	if ad.pending == nil {
+		ch := make(chan readResult, 1)
+		ad.pending = ch
+
+		go func() {
+			ch <- ad.read()
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		return readResult{}, ctx.Err()
+	case res := <-ad.pending:
+		ad.pending = nil
+		return res, nil
+	}
+}
+
+// Subscribe reads messages in the background until the context is cancelled
+// or the stream ends, sending them on the returned message channel. Messages
+// which fail to parse are reported on the error channel and reading carries
+// on. An error reading from the stream is also reported on the error channel,
+// after which both channels get closed.
+//
+// Cancelling the context closes both channels without waiting for the
+// pending read. As with ReadContext, a message arriving after cancellation
+// isn't lost and is returned by the next read or subscription. Subscribe must
+// not be used concurrently with Read, ReadContext or another subscription.
+func (ad *AlarmDecoder) Subscribe(ctx context.Context) (<-chan Message, <-chan error) {
+	msgs := make(chan Message)
+	errs := make(chan error)
+
+	go func() {
+		defer close(msgs)
+		defer close(errs)
+
+		for {
+			res, err := ad.readContext(ctx)
+			if err != nil {
+				return
+			}
+
+			if res.err != nil {
+				select {
+				case errs <- res.err:
+				case <-ctx.Done():
+					ad.requeue(res)
+					return
+				}
+
+				if res.closed {
+					return
+				}
+
+				continue
+			}
+
+			select {
+			case msgs <- res.msg:
+			case <-ctx.Done():
+				ad.requeue(res)
+				return
+			}
+		}
+	}()
+
+	return msgs, errs
+}
+
+// requeue makes a read result which couldn't be delivered available to the
+// next read.
+func (ad *AlarmDecoder) requeue(res readResult) {
+	ch := make(chan readResult, 1)
+	ch <- res
+	ad.pending = ch
+}
+
+// read blocks until a single message is read from the stream.
+func (ad *AlarmDecoder) read() readResult {
 	hasMsg := ad.scanner.Scan()
+	for hasMsg && ad.scanner.Text() == "" && !ad.dropped {
+		// Skip empty lines, such as the second half of a \r\n.
+		hasMsg = ad.scanner.Scan()
+	}
+
 	if err := ad.scanner.Err(); err != nil {
-		return Message{}, err
+		return readResult{err: err, closed: true}
 	}
 	if hasMsg {
-		return ParseMessage(ad.scanner.Text())
+		if ad.dropped {
+			ad.dropped = false
+			return readResult{err: ErrLineTooLong}
+		}
+
+		msg, err := ParseMessage(ad.scanner.Text())
+		if err != nil {
+			return readResult{err: err}
+		}
+
+		ad.seq++
+		msg.Seq = ad.seq
+		msg.ReceivedAt = ad.clock.Now()
+
+		if msg.Mode != "" {
+			ad.detectMode(msg.Mode)
+		}
+
+		return readResult{msg: msg}
 	}
-	return Message{}, io.EOF
+	return readResult{err: ErrClosed, closed: true}
+}
+
+// RequestVersion asks the AlarmDecoder to report its version, which gets
+// received as a !VER message.
+func (ad *AlarmDecoder) RequestVersion() error {
+	return ad.Write([]byte("V\r\n"))
 }
 
 // Write sends a text command to the alarm.
 func (ad *AlarmDecoder) Write(msg []byte) error {
+	ad.writeLock.Lock()
+	defer ad.writeLock.Unlock()
+
+	if ad.writesDisabled {
+		return ErrReadOnly
+	}
+
 	_, err := ad.rw.Write(msg)
 	return err
 }
+
+// SendKeys sends a sequence of keypresses to the alarm, one at a time. The
+// whole sequence is sent before any other write goes through.
+func (ad *AlarmDecoder) SendKeys(keys string) error {
+	ad.writeLock.Lock()
+	defer ad.writeLock.Unlock()
+
+	if ad.writesDisabled {
+		return ErrReadOnly
+	}
+
+	for i, c := range keys {
+		if i > 0 {
+			<-ad.clock.After(ad.keyDelay)
+		}
+
+		_, err := ad.rw.Write([]byte(string(c)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SendAddressed sends a sequence of keypresses as the keypad at the given
+// address. The address prefix and the keys go out as a single write, the
+// AlarmDecoder then sending the keys from that keypad.
+func (ad *AlarmDecoder) SendAddressed(address int, keys string) error {
+	return ad.Write([]byte(fmt.Sprintf("K%02d%s", address, keys)))
+}
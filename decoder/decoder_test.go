@@ -2,11 +2,17 @@ package alarmdecoder
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/stgraber/ad2mqtt/decoder/decodertest"
 )
 
 func TestParse(t *testing.T) {
@@ -17,14 +23,17 @@ func TestParse(t *testing.T) {
 		{
 			`[10000601100000003A--],045,[f71f00000045001c28020000000000],"****DISARMED****  READY TO ARM  "`,
 			Message{
-				Ready:         true,
-				Beeps:         6,
-				ACPower:       true,
-				ChimeEnabled:  true,
-				Mode:          "A",
-				Zone:          "045",
-				RawData:       "[f71f00000045001c28020000000000]",
-				KeypadMessage: "****DISARMED****  READY TO ARM",
+				Ready:          true,
+				Beeps:          6,
+				ACPower:        true,
+				ChimeEnabled:   true,
+				Mode:           "A",
+				SystemSpecific: 3,
+				Zone:           "045",
+				RawData:        "[f71f00000045001c28020000000000]",
+				KeypadMessage:  "****DISARMED****  READY TO ARM",
+
+				KeypadAddressMask: 0x1f000000,
 			},
 		},
 		{
@@ -33,23 +42,72 @@ func TestParse(t *testing.T) {
 				AlarmHasOccured: true,
 				AlarmSounding:   true,
 				Mode:            "A",
+				SystemSpecific:  3,
 				KeypadMessage:   "test",
 			},
 		},
 		{
 			`[00000000000001003A--],,,"test"`,
 			Message{
-				Fire:          true,
-				Mode:          "A",
-				KeypadMessage: "test",
+				Fire:           true,
+				Mode:           "A",
+				SystemSpecific: 3,
+				KeypadMessage:  "test",
 			},
 		},
 		{
 			`[00000000000000103A--],,,"test"`,
 			Message{
-				SystemIssue:   true,
-				Mode:          "A",
-				KeypadMessage: "test",
+				SystemIssue:    true,
+				Mode:           "A",
+				SystemSpecific: 3,
+				KeypadMessage:  "test",
+			},
+		},
+		{
+			`[01000001100000003A--],005,[f70000000005001c28020000000000],"FAULT 05, 06 SOMETHING"`,
+			Message{
+				ArmedAway:      true,
+				ACPower:        true,
+				ChimeEnabled:   true,
+				Mode:           "A",
+				SystemSpecific: 3,
+				Zone:           "005",
+				RawData:        "[f70000000005001c28020000000000]",
+				KeypadMessage:  "FAULT 05, 06 SOMETHING",
+			},
+		},
+		{
+			`[0000000000000000FD--],,,"test"`,
+			Message{
+				SystemSpecific: 0xf,
+				Mode:           "D",
+				KeypadMessage:  "test",
+			},
+		},
+		{
+			`!LRR:012,1,CID_1130,ff`,
+			Message{
+				LRR: &LRRMessage{
+					EventData:  "012",
+					Partition:  1,
+					EventType:  "CID_1130",
+					Qualifier:  1,
+					EventCode:  "130",
+					ReportCode: "ff",
+				},
+			},
+		},
+		{
+			`!LRR:012,1,CID_3130`,
+			Message{
+				LRR: &LRRMessage{
+					EventData: "012",
+					Partition: 1,
+					EventType: "CID_3130",
+					Qualifier: 3,
+					EventCode: "130",
+				},
 			},
 		},
 	}
@@ -66,6 +124,116 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestKeypadAddressMask(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want uint32
+	}{
+		{`[10000601100000003A--],045,[f71f00000045001c28020000000000],"test"`, 0x1f000000},
+		{`[01000001100000003A--],005,[f70000000005001c28020000000000],"test"`, 0},
+		{`[01000001100000003A--],005,[f700000c0005001c28020000000000],"test"`, 0x00000c00},
+		{`[00000000011000003A--],,,"test"`, 0},
+	}
+
+	for i, c := range cases {
+		msg, err := ParseMessage(c.raw)
+		if err != nil {
+			t.Errorf("%d. ParseMessage(%q) failed: %v", i, c.raw, err)
+			continue
+		}
+
+		if msg.KeypadAddressMask != c.want {
+			t.Errorf("%d. got mask %08x; wanted %08x", i, msg.KeypadAddressMask, c.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	cases := []string{
+		``,
+		`garbage`,
+		`[1000],045,[f71f],"test"`,
+		`[10000601100000003A--],045,[f71f00000045001c28020000000000],`,
+		`[10000601100000003A--],045,[f71f00000045001c28020000000000],"`,
+		`[10000X01100000003A--],045,[f71f00000045001c28020000000000],"test"`,
+		`[10000601100000003A--],045,[f71f],"test"`,
+		`[10000601100000003A--],045,[f7zz00000045001c28020000000000],"test"`,
+		`[1000060110000000GA--],045,[f71f00000045001c28020000000000],"test"`,
+	}
+
+	for i, raw := range cases {
+		_, err := ParseMessage(raw)
+		if err == nil {
+			t.Errorf("%d. ParseMessage(%q) should have failed", i, raw)
+		}
+	}
+}
+
+func TestNormalizedKeypadMessage(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want string
+	}{
+		{`[10000601100000003A--],045,[f71f00000045001c28020000000000],"****DISARMED****  READY TO ARM  "`, "****DISARMED**** READY TO ARM"},
+		{`[00000001100000003A--],005,[f70000000005001c28020000000000],"FAULT 05  FRONT   DOOR    "`, "FAULT 05 FRONT DOOR"},
+		{`[00000001100000003A--],005,[f70000000005001c28020000000000],"  NOT READY"`, "NOT READY"},
+	}
+
+	for i, c := range cases {
+		msg, err := ParseMessage(c.raw)
+		if err != nil {
+			t.Errorf("%d. ParseMessage(%q) failed: %v", i, c.raw, err)
+			continue
+		}
+
+		if msg.NormalizedKeypadMessage() != c.want {
+			t.Errorf("%d. got %q; wanted %q", i, msg.NormalizedKeypadMessage(), c.want)
+		}
+	}
+
+	// The trimmed text is kept as is.
+	msg, err := ParseMessage(cases[1].raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.KeypadMessage != "FAULT 05  FRONT   DOOR" {
+		t.Errorf("got keypad message %q", msg.KeypadMessage)
+	}
+}
+
+func TestType(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want EventType
+	}{
+		{`[10000601100000003A--],045,[f71f00000045001c28020000000000],"****DISARMED****  READY TO ARM  "`, EventKeypadUpdate},
+		{`[01000001100000003A--],005,[f70000000005001c28020000000000],"ARMED ***AWAY***"`, EventKeypadUpdate},
+		{`[00000001100000003A--],005,[f70000000005001c28020000000000],"FAULT 05 FRONT DOOR"`, EventFault},
+		{`!LRR:012,1,CID_1130,ff`, EventLRR},
+		{`!RFX:0123456,80`, EventRFX},
+		{`!EXP:07,01,01`, EventExpander},
+		{`!REL:12,02,01`, EventRelay},
+	}
+
+	for i, c := range cases {
+		out, err := ParseMessage(c.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Type() != c.want {
+			t.Errorf("%d. ParseMessage(%q).Type() = %s; not %s", i, c.raw, out.Type(), c.want)
+		}
+		if out.String() == "" {
+			t.Errorf("%d. ParseMessage(%q).String() is empty", i, c.raw)
+		}
+	}
+
+	if (Message{}).Type() != EventUnknown {
+		t.Errorf("empty message should be of unknown type")
+	}
+}
+
 type dummyRW struct {
 	r io.Reader
 	w io.Writer
@@ -85,6 +253,188 @@ func (rw *dummyRW) Write(p []byte) (n int, err error) {
 	return 0, errors.Errorf("unimplemented")
 }
 
+func TestParseVersion(t *testing.T) {
+	raw := `!VER:ffffffff,V2.2a.8.8,TX;RX;SM;VZ;RF;ZX;RE;AU;3X;CG;DD;MF;LR;KE;MK;CB;DS;ER;CR`
+	msg, err := ParseMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &VersionMessage{
+		SerialNumber: "ffffffff",
+		Firmware:     "V2.2a.8.8",
+		Capabilities: []string{"TX", "RX", "SM", "VZ", "RF", "ZX", "RE", "AU", "3X", "CG", "DD", "MF", "LR", "KE", "MK", "CB", "DS", "ER", "CR"},
+	}
+
+	if !reflect.DeepEqual(msg.Version, want) {
+		t.Errorf("got %+v; wanted %+v", msg.Version, want)
+	}
+
+	if msg.Type() != EventVersion {
+		t.Errorf("got type %s; wanted %s", msg.Type(), EventVersion)
+	}
+
+	if !msg.Version.HasCapability("RF") || msg.Version.HasCapability("XX") {
+		t.Errorf("unexpected capabilities %q", msg.Version.Capabilities)
+	}
+
+	msg, err = ParseMessage(`!VER:ffffffff,V2.2a.8.8,TX;RX,ff00`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Version.ConfigBits != 0xff00 {
+		t.Errorf("got config bits %x; wanted ff00", msg.Version.ConfigBits)
+	}
+
+	for _, raw := range []string{`!VER:ffffffff,V2.2a.8.8`, `!VER:zz,V2.2a.8.8,TX`, `!VER:ffffffff,V2.2a.8.8,TX,zz`} {
+		_, err := ParseMessage(raw)
+		if err == nil {
+			t.Errorf("ParseMessage(%q) should have failed", raw)
+		}
+	}
+}
+
+func TestParseRFX(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want RFXMessage
+	}{
+		{`!RFX:0123456,80`, RFXMessage{SerialNumber: "0123456", Loop1: true}},
+		{`!RFX:0123456,20`, RFXMessage{SerialNumber: "0123456", Loop2: true}},
+		{`!RFX:0123456,10`, RFXMessage{SerialNumber: "0123456", Loop3: true}},
+		{`!RFX:0123456,40`, RFXMessage{SerialNumber: "0123456", Loop4: true}},
+		{`!RFX:0123456,02`, RFXMessage{SerialNumber: "0123456", LowBattery: true}},
+		{`!RFX:0123456,04`, RFXMessage{SerialNumber: "0123456", Supervision: true}},
+		{`!RFX:0987654,00`, RFXMessage{SerialNumber: "0987654"}},
+		{`!RFX:0987654,F6`, RFXMessage{SerialNumber: "0987654", Loop1: true, Loop2: true, Loop3: true, Loop4: true, LowBattery: true, Supervision: true}},
+	}
+
+	for i, c := range cases {
+		out, err := ParseMessage(c.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Message{UnparsedMessage: c.raw, RFX: &c.want}
+		if !reflect.DeepEqual(out, want) {
+			t.Errorf("%d. ParseMessage(%q) = %+v; not %+v", i, c.raw, out.RFX, c.want)
+		}
+	}
+}
+
+func TestParseExpanderRelay(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want Message
+	}{
+		{`!EXP:07,01,01`, Message{Expander: &ExpanderMessage{Address: 7, Channel: 1, State: true}}},
+		{`!EXP:08,03,00`, Message{Expander: &ExpanderMessage{Address: 8, Channel: 3}}},
+		{`!REL:12,02,01`, Message{Relay: &RelayMessage{Address: 12, Channel: 2, State: true}}},
+		{`!REL:13,04,00`, Message{Relay: &RelayMessage{Address: 13, Channel: 4}}},
+	}
+
+	for i, c := range cases {
+		c.want.UnparsedMessage = c.raw
+		out, err := ParseMessage(c.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out, c.want) {
+			t.Errorf("%d. ParseMessage(%q) = %+v; not %+v", i, c.raw, out, c.want)
+		}
+	}
+
+	for _, raw := range []string{`!EXP:07,01`, `!REL:xx,01,01`} {
+		_, err := ParseMessage(raw)
+		if err == nil {
+			t.Errorf("ParseMessage(%q) should have failed", raw)
+		}
+	}
+}
+
+func TestFlags(t *testing.T) {
+	for _, raw := range []string{
+		`[10000601100000003A--],045,[f71f00000045001c28020000000000],"****DISARMED****  READY TO ARM  "`,
+		`[00000000011000003A--],,,"test"`,
+		`[00000000000001003A--],,,"test"`,
+		`[00000000000000103A--],,,"test"`,
+		`[01000001100000003A--],005,[f70000000005001c28020000000000],"FAULT 05, 06 SOMETHING"`,
+		`[11111111111111113A--],0a1,,"all"`,
+	} {
+		msg, err := ParseMessage(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		flags := msg.Flags()
+		for _, bit := range []struct {
+			flag  StateFlags
+			value bool
+		}{
+			{FlagReady, msg.Ready},
+			{FlagArmedAway, msg.ArmedAway},
+			{FlagArmedHome, msg.ArmedHome},
+			{FlagBacklightOn, msg.BacklightOn},
+			{FlagProgrammingMode, msg.ProgrammingMode},
+			{FlagZoneBypassed, msg.ZoneBypassed},
+			{FlagACPower, msg.ACPower},
+			{FlagChimeEnabled, msg.ChimeEnabled},
+			{FlagAlarmHasOccured, msg.AlarmHasOccured},
+			{FlagAlarmSounding, msg.AlarmSounding},
+			{FlagBatteryLow, msg.BatteryLow},
+			{FlagEntryDelayDisabled, msg.EntryDelayDisabled},
+			{FlagFire, msg.Fire},
+			{FlagSystemIssue, msg.SystemIssue},
+			{FlagPerimeterOnly, msg.PerimeterOnly},
+			{FlagZoneBusFailure, msg.ZoneBusFailure},
+		} {
+			if flags.Has(bit.flag) != bit.value {
+				t.Errorf("flags %#x of %q: got %v for flag %#x; wanted %v", flags, raw, flags.Has(bit.flag), bit.flag, bit.value)
+			}
+		}
+	}
+
+	// Transitions are found by comparing the bitmasks.
+	before := Message{Ready: true, ACPower: true}
+	after := Message{ArmedAway: true, ACPower: true}
+	if changed := before.Flags() ^ after.Flags(); changed != FlagReady|FlagArmedAway {
+		t.Errorf("got changed flags %#x; wanted %#x", changed, FlagReady|FlagArmedAway)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	var buf bytes.Buffer
+	ad := New(&dummyRW{w: &buf})
+	ad.SetKeyDelay(0)
+	ad.SetReadOnly(true)
+
+	err := ad.SendKeys("12341")
+	if err != ErrReadOnly {
+		t.Errorf("got error %v; wanted %v", err, ErrReadOnly)
+	}
+
+	err = ad.RequestVersion()
+	if err != ErrReadOnly {
+		t.Errorf("got error %v; wanted %v", err, ErrReadOnly)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be written, got %q", buf.String())
+	}
+}
+
+func TestParseAUI(t *testing.T) {
+	raw := `!AUI:420000000000000000000000000000000000000000000000000000000000000000`
+	msg, err := ParseMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Type() != EventAUI || msg.AUI.Data != strings.TrimPrefix(raw, "!AUI:") {
+		t.Errorf("ParseMessage(%q) = %+v", raw, msg)
+	}
+}
+
 func TestRead(t *testing.T) {
 	var buf bytes.Buffer
 	buf.WriteString("[00000000011000003A--],,,\"test\"\n")
@@ -96,14 +446,545 @@ func TestRead(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	// The read metadata isn't part of the parsed message.
+	if out.Seq != 1 || out.ReceivedAt.IsZero() {
+		t.Errorf("got sequence %d received at %v; wanted 1 with a timestamp", out.Seq, out.ReceivedAt)
+	}
+	out.Seq = 0
+	out.ReceivedAt = time.Time{}
+
 	want := Message{
 		UnparsedMessage: "[00000000011000003A--],,,\"test\"",
 		AlarmHasOccured: true,
 		AlarmSounding:   true,
 		Mode:            "A",
+		SystemSpecific:  3,
 		KeypadMessage:   "test",
 	}
 	if !reflect.DeepEqual(out, want) {
 		t.Errorf("got %+v; wanted %+v", out, want)
 	}
 }
+
+func TestReadContext(t *testing.T) {
+	r, w := io.Pipe()
+	rw := dummyRW{
+		r: r,
+	}
+	ad := New(&rw)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := ad.ReadContext(ctx)
+	if err != context.Canceled {
+		t.Fatalf("got %v; wanted %v", err, context.Canceled)
+	}
+
+	// The message received after cancellation is returned by the next read.
+	go w.Write([]byte("[00000000011000003A--],,,\"test\"\n"))
+	out, err := ad.ReadContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.KeypadMessage != "test" {
+		t.Errorf("got %+v; wanted keypad message %q", out, "test")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("[00000000011000003A--],,,\"one\"\ngarbage\n[00000000011000003A--],,,\"two\"\n")
+	rw := dummyRW{
+		r: &buf,
+	}
+	ad := New(&rw)
+
+	msgs, errs := ad.Subscribe(context.Background())
+
+	var got []string
+	var seqs []uint64
+	var parseErrs int
+	for msgs != nil || errs != nil {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				msgs = nil
+				continue
+			}
+			got = append(got, msg.KeypadMessage)
+			seqs = append(seqs, msg.Seq)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			if err == ErrClosed {
+				continue
+			}
+			parseErrs++
+		}
+	}
+
+	if !reflect.DeepEqual(got, []string{"one", "two"}) || parseErrs != 1 {
+		t.Errorf("got messages %q with %d parse errors; wanted %q with 1", got, parseErrs, []string{"one", "two"})
+	}
+
+	if !reflect.DeepEqual(seqs, []uint64{1, 2}) {
+		t.Errorf("got sequence numbers %v; wanted %v", seqs, []uint64{1, 2})
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	r, w := io.Pipe()
+	rw := dummyRW{
+		r: r,
+	}
+	ad := New(&rw)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs, errs := ad.Subscribe(ctx)
+	cancel()
+
+	// Both channels get closed.
+	for range msgs {
+	}
+	for range errs {
+	}
+
+	// The message received after cancellation is returned by the next read.
+	go w.Write([]byte("[00000000011000003A--],,,\"test\"\n"))
+	out, err := ad.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.KeypadMessage != "test" {
+		t.Errorf("got %+v; wanted keypad message %q", out, "test")
+	}
+}
+
+func TestReadLineEndings(t *testing.T) {
+	for _, ending := range []string{"\n", "\r\n", "\r"} {
+		var buf bytes.Buffer
+		buf.WriteString("[00000000011000003A--],,,\"one\"" + ending)
+		buf.WriteString("[00000000011000003A--],,,\"two\"" + ending)
+		rw := dummyRW{
+			r: &buf,
+		}
+		ad := New(&rw)
+
+		for _, want := range []string{"one", "two"} {
+			out, err := ad.Read()
+			if err != nil {
+				t.Fatalf("%q: %v", ending, err)
+			}
+
+			if out.KeypadMessage != want || out.Mode != "A" || out.UnparsedMessage != "[00000000011000003A--],,,\""+want+"\"" {
+				t.Errorf("%q: got %+v; wanted keypad message %q", ending, out, want)
+			}
+		}
+
+		_, err := ad.Read()
+		if err != ErrClosed {
+			t.Errorf("%q: got %v; wanted %v", ending, err, ErrClosed)
+		}
+	}
+}
+
+func TestReadLongLine(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("[" + strings.Repeat("0", MaxLineLength*2) + "\n")
+	buf.WriteString("[00000000011000003A--],,,\"test\"\n")
+	rw := dummyRW{
+		r: &buf,
+	}
+	ad := New(&rw)
+
+	_, err := ad.Read()
+	if err != ErrLineTooLong {
+		t.Fatalf("got %v; wanted %v", err, ErrLineTooLong)
+	}
+
+	// Reading carries on with the next line.
+	out, err := ad.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.KeypadMessage != "test" {
+		t.Errorf("got %+v; wanted keypad message %q", out, "test")
+	}
+
+	_, err = ad.Read()
+	if err != ErrClosed {
+		t.Errorf("got %v; wanted %v", err, ErrClosed)
+	}
+}
+
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func TestSendKeys(t *testing.T) {
+	var buf lockedBuffer
+	rw := dummyRW{
+		w: &buf,
+	}
+	ad := New(&rw)
+	ad.SetKeyDelay(time.Millisecond)
+
+	var wg sync.WaitGroup
+	for _, keys := range []string{"1234", "#2"} {
+		wg.Add(1)
+		go func(keys string) {
+			defer wg.Done()
+			err := ad.SendKeys(keys)
+			if err != nil {
+				t.Error(err)
+			}
+		}(keys)
+	}
+	wg.Wait()
+
+	out := buf.buf.String()
+	if out != "1234#2" && out != "#21234" {
+		t.Errorf("got interleaved keys %q", out)
+	}
+}
+
+// writeRecorder records each write separately.
+type writeRecorder struct {
+	writes []string
+}
+
+func (r *writeRecorder) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, string(p))
+	return len(p), nil
+}
+
+func TestSendAddressed(t *testing.T) {
+	var rec writeRecorder
+	ad := New(&dummyRW{w: &rec})
+	ad.SetKeyDelay(0)
+
+	// The address and keys go out together rather than as keypresses.
+	err := ad.SendAddressed(18, "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ad.Keypad(18).ArmAway("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ad.Keypad(0).SendKeys("12")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"K181234", "K1812342", "1", "2"}
+	if !reflect.DeepEqual(rec.writes, want) {
+		t.Errorf("got writes %q; wanted %q", rec.writes, want)
+	}
+}
+
+// fakeClock is a Clock which only moves forward when waited on.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	waited []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	c.waited = append(c.waited, d)
+
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// AfterFunc uses the system time as the decoder doesn't use timers.
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func TestClock(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	var buf bytes.Buffer
+	rw := dummyRW{
+		r: strings.NewReader("[00000000011000003A--],,,\"test\"\n"),
+		w: &buf,
+	}
+	ad := New(&rw)
+	ad.SetClock(clock)
+	ad.SetKeyDelay(time.Second)
+
+	out, err := ad.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.ReceivedAt.Equal(clock.now) {
+		t.Errorf("got message received at %v; wanted %v", out.ReceivedAt, clock.now)
+	}
+
+	// Keys are delayed through the clock.
+	err = ad.SendKeys("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(clock.waited, []time.Duration{time.Second, time.Second}) {
+		t.Errorf("got delays %v; wanted two of %v", clock.waited, time.Second)
+	}
+}
+
+func TestPanel(t *testing.T) {
+	cases := []struct {
+		mode     string
+		armAway  string
+		armHome  string
+		armNight string
+		disarm   string
+		bypass   string
+	}{
+		{"A", "#2", "#3", "12347", "12341", "#605"},
+		{"", "#2", "#3", "12347", "12341", "#605"},
+		{"D", "\x05\x05\x05", "\x04\x04\x04", "*91234", "1234", "*105#"},
+	}
+
+	for i, c := range cases {
+		panel := PanelForMode(c.mode)
+		got := []string{panel.ArmAway(""), panel.ArmHome(""), panel.ArmNight("1234"), panel.Disarm("1234"), panel.Bypass("", 5)}
+		want := []string{c.armAway, c.armHome, c.armNight, c.disarm, c.bypass}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d. got keys %q for mode %q; wanted %q", i, got, c.mode, want)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	var buf bytes.Buffer
+	rw := dummyRW{
+		r: strings.NewReader("[10000001100000003D--],,,\"test\"\n[10000001100000003A--],,,\"test\"\n"),
+		w: &buf,
+	}
+	ad := New(&rw)
+	ad.SetKeyDelay(0)
+
+	// Ademco is assumed until a message reports the mode.
+	err := ad.ArmAway("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "#2" {
+		t.Errorf("got keys %q; wanted %q", buf.String(), "#2")
+	}
+
+	_, err = ad.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ad.Mode() != "D" {
+		t.Fatalf("got mode %q; wanted %q", ad.Mode(), "D")
+	}
+
+	buf.Reset()
+	err = ad.Disarm("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "1234" {
+		t.Errorf("got keys %q; wanted %q", buf.String(), "1234")
+	}
+
+	buf.Reset()
+	ad.SetMode("A")
+	err = ad.ArmHome("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "12343" {
+		t.Errorf("got keys %q; wanted %q", buf.String(), "12343")
+	}
+
+	// A forced mode isn't overridden by the keypad messages.
+	ad.ForceMode("D")
+	_, err = ad.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	err = ad.ArmNight("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "*91234" {
+		t.Errorf("got keys %q; wanted %q", buf.String(), "*91234")
+	}
+
+	// Keypads prefix the keys with their address.
+	buf.Reset()
+	err = ad.Keypad(18).Bypass("1234", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "K18*1123405#" {
+		t.Errorf("got keys %q; wanted %q", buf.String(), "K18*1123405#")
+	}
+}
+
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		raw   string
+		field string
+	}{
+		{`[10000X01100000003A--],045,[f71f00000045001c28020000000000],"test"`, "beeps"},
+		{`[1000060110000000GA--],045,[f71f00000045001c28020000000000],"test"`, "system specific bits"},
+		{`[10000601100000003A--],045,[f71f],"test"`, "raw data"},
+		{`[100006011],045,[f71f00000045001c28020000000000],"test"`, "bit field"},
+		{`!EXP:07,zz,1`, "EXP message"},
+	}
+
+	for i, c := range cases {
+		_, err := ParseMessage(c.raw)
+
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("%d. ParseMessage(%q) returned %v; wanted a *ParseError", i, c.raw, err)
+			continue
+		}
+
+		if parseErr.Field != c.field {
+			t.Errorf("%d. got field %q; wanted %q", i, parseErr.Field, c.field)
+		}
+
+		if parseErr.Line != c.raw {
+			t.Errorf("%d. got line %q; wanted %q", i, parseErr.Line, c.raw)
+		}
+	}
+}
+
+func TestZoneNumber(t *testing.T) {
+	cases := []struct {
+		raw        string
+		zone       int
+		busFailure bool
+	}{
+		{`[00000001000000000A--],022,[f70000000022000000000000000000],"FAULT 22"`, 22, false},
+		{`[00000001000000100A--],0fc,[f70000000022000000000000000000],"CHECK 102"`, 252, true},
+		{`[00000001000000100A--],010,[f70000000022000000000000000000],"CHECK 016"`, 16, true},
+		{`[00000001000000100A--],022,[f70000000022000000000000000000],"CHECK 22 FRONT DOOR"`, 22, false},
+		{`[00000001000000000A--],010,[f70000000022000000000000000000],"CHECK 016"`, 10, false},
+	}
+
+	for i, c := range cases {
+		msg, err := ParseMessage(c.raw)
+		if err != nil {
+			t.Fatalf("%d. ParseMessage(%q) failed: %v", i, c.raw, err)
+		}
+
+		if msg.ZoneBusFailure != c.busFailure {
+			t.Errorf("%d. got bus failure %v; wanted %v", i, msg.ZoneBusFailure, c.busFailure)
+		}
+
+		zone, err := msg.ZoneNumber()
+		if err != nil {
+			t.Errorf("%d. ZoneNumber() failed: %v", i, err)
+		} else if zone != c.zone {
+			t.Errorf("%d. got zone %d; wanted %d", i, zone, c.zone)
+		}
+	}
+
+	_, err := Message{Zone: ""}.ZoneNumber()
+	if err == nil {
+		t.Errorf("ZoneNumber() of an empty zone should have failed")
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	input := strings.Join([]string{
+		`[10000001100000003A--],000,[f70000000000000000000000000000],"READY"`,
+		`[00000001100000003A--],005,[f70000000005000000000000000000],"FAULT 05"`,
+		`garbage`,
+		`!EXP:07,01,1`,
+	}, "\r\n") + "\r\n"
+
+	msgs, errs := DecodeAll(strings.NewReader(input))
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages; wanted %d", len(msgs), 3)
+	}
+
+	if msgs[1].Zone != "005" || msgs[2].Expander == nil {
+		t.Errorf("unexpected messages %+v", msgs)
+	}
+
+	if msgs[2].Seq != 3 {
+		t.Errorf("got sequence number %d; wanted %d", msgs[2].Seq, 3)
+	}
+
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors; wanted %d", len(errs), 1)
+	}
+
+	var parseErr *ParseError
+	if !errors.As(errs[0], &parseErr) || parseErr.Line != "garbage" {
+		t.Errorf("got error %v; wanted a ParseError for %q", errs[0], "garbage")
+	}
+}
+
+func TestScriptedPanel(t *testing.T) {
+	panel := decodertest.NewPanel(`[10000001100000003A--],,,"READY"`)
+	panel.On("12342", `[01000001100000003A--],,,"ARMED ***AWAY***"`)
+	defer panel.Close()
+
+	ad := New(panel)
+	ad.SetKeyDelay(0)
+
+	msg, err := ad.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !msg.Ready || msg.ArmedAway {
+		t.Fatalf("expected the panel to be ready, got %s", msg)
+	}
+
+	// The panel only reports being armed once the whole sequence was sent.
+	err = ad.ArmAway("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = ad.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !msg.ArmedAway || panel.Written() != "12342" {
+		t.Errorf("got %s after writing %q", msg, panel.Written())
+	}
+
+	// Closing the panel ends the stream.
+	panel.Close()
+	_, err = ad.Read()
+	if err != ErrClosed {
+		t.Errorf("got error %v; wanted %v", err, ErrClosed)
+	}
+}
@@ -0,0 +1,128 @@
+// Package decodertest provides a fake AlarmDecoder connection for tests.
+package decodertest
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+)
+
+// response holds the lines sent back once the keys were written.
+type response struct {
+	keys  string
+	lines []string
+}
+
+// Panel is an io.ReadWriteCloser behaving like an AlarmDecoder. It replies
+// to the keys written to it with scripted lines, so command round-trips can
+// be tested. Reads block until a line is available or the panel is closed.
+type Panel struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	pending   bytes.Buffer
+	written   bytes.Buffer
+	unmatched string
+	responses []response
+	closed    bool
+}
+
+// NewPanel returns a panel which first reads the given lines.
+func NewPanel(lines ...string) *Panel {
+	p := &Panel{}
+	p.cond = sync.NewCond(&p.lock)
+	p.Send(lines...)
+
+	return p
+}
+
+// On queues lines to be read once the keys were written to the panel, in
+// one or several writes. Responses are used once, in the order they were
+// registered.
+func (p *Panel) On(keys string, lines ...string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.responses = append(p.responses, response{keys: keys, lines: lines})
+}
+
+// Send queues lines to be read, as if sent by the panel on its own.
+func (p *Panel) Send(lines ...string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.send(lines)
+}
+
+// send queues lines, the caller must hold the lock.
+func (p *Panel) send(lines []string) {
+	for _, line := range lines {
+		p.pending.WriteString(line + "\r\n")
+	}
+
+	p.cond.Broadcast()
+}
+
+// Written returns everything written to the panel so far.
+func (p *Panel) Written() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.written.String()
+}
+
+// Read returns the queued lines, blocking until there are some.
+func (p *Panel) Read(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for p.pending.Len() == 0 && !p.closed {
+		p.cond.Wait()
+	}
+
+	if p.pending.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return p.pending.Read(b)
+}
+
+// Write records the keys and queues the lines of the next response once
+// its keys were written.
+func (p *Panel) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	p.written.Write(b)
+	p.unmatched += string(b)
+
+	if len(p.responses) > 0 {
+		next := p.responses[0]
+
+		i := strings.Index(p.unmatched, next.keys)
+		if i >= 0 {
+			p.unmatched = p.unmatched[i+len(next.keys):]
+			p.responses = p.responses[1:]
+			p.send(next.lines)
+		}
+	}
+
+	return len(b), nil
+}
+
+// Close makes pending and future reads fail with io.EOF once the queued
+// lines were read.
+func (p *Panel) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package alarmdecoder
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EventType indicates what kind of message was received from the AlarmDecoder.
+type EventType int
+
+const (
+	// EventUnknown is used for empty messages.
+	EventUnknown EventType = iota
+	// EventKeypadUpdate is a regular keypad message.
+	EventKeypadUpdate
+	// EventFault is a keypad message reporting a faulted zone.
+	EventFault
+	// EventLRR is a Long Range Radio message.
+	EventLRR
+	// EventRFX is a wireless sensor message.
+	EventRFX
+	// EventExpander is a zone expander message.
+	EventExpander
+	// EventRelay is a relay module message.
+	EventRelay
+	// EventVersion is the version information of the AlarmDecoder.
+	EventVersion
+	// EventAUI is an Ademco AUI message.
+	EventAUI
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventKeypadUpdate:
+		return "keypad"
+	case EventFault:
+		return "fault"
+	case EventLRR:
+		return "lrr"
+	case EventRFX:
+		return "rfx"
+	case EventExpander:
+		return "expander"
+	case EventRelay:
+		return "relay"
+	case EventVersion:
+		return "version"
+	case EventAUI:
+		return "aui"
+	}
+
+	return "unknown"
+}
+
+// Type returns the kind of message.
+func (m Message) Type() EventType {
+	if m.LRR != nil {
+		return EventLRR
+	} else if m.RFX != nil {
+		return EventRFX
+	} else if m.Expander != nil {
+		return EventExpander
+	} else if m.Relay != nil {
+		return EventRelay
+	} else if m.Version != nil {
+		return EventVersion
+	} else if m.AUI != nil {
+		return EventAUI
+	} else if m.UnparsedMessage == "" {
+		return EventUnknown
+	} else if !m.Ready && !m.ArmedAway && !m.ArmedHome {
+		return EventFault
+	}
+
+	return EventKeypadUpdate
+}
+
+// StateFlags is a bitmask of the keypad message bits, making it easy to
+// compare two messages.
+type StateFlags uint32
+
+// Flags matching the Message fields of the same name.
+const (
+	FlagReady StateFlags = 1 << iota
+	FlagArmedAway
+	FlagArmedHome
+	FlagBacklightOn
+	FlagProgrammingMode
+	FlagZoneBypassed
+	FlagACPower
+	FlagChimeEnabled
+	FlagAlarmHasOccured
+	FlagAlarmSounding
+	FlagBatteryLow
+	FlagEntryDelayDisabled
+	FlagFire
+	FlagSystemIssue
+	FlagPerimeterOnly
+	FlagZoneBusFailure
+)
+
+// Has returns whether all the given flags are set.
+func (f StateFlags) Has(flags StateFlags) bool {
+	return f&flags == flags
+}
+
+// Flags returns the keypad message bits as a bitmask.
+func (m Message) Flags() StateFlags {
+	var flags StateFlags
+	for _, bit := range []struct {
+		flag  StateFlags
+		value bool
+	}{
+		{FlagReady, m.Ready},
+		{FlagArmedAway, m.ArmedAway},
+		{FlagArmedHome, m.ArmedHome},
+		{FlagBacklightOn, m.BacklightOn},
+		{FlagProgrammingMode, m.ProgrammingMode},
+		{FlagZoneBypassed, m.ZoneBypassed},
+		{FlagACPower, m.ACPower},
+		{FlagChimeEnabled, m.ChimeEnabled},
+		{FlagAlarmHasOccured, m.AlarmHasOccured},
+		{FlagAlarmSounding, m.AlarmSounding},
+		{FlagBatteryLow, m.BatteryLow},
+		{FlagEntryDelayDisabled, m.EntryDelayDisabled},
+		{FlagFire, m.Fire},
+		{FlagSystemIssue, m.SystemIssue},
+		{FlagPerimeterOnly, m.PerimeterOnly},
+		{FlagZoneBusFailure, m.ZoneBusFailure},
+	} {
+		if bit.value {
+			flags |= bit.flag
+		}
+	}
+
+	return flags
+}
+
+// NormalizedKeypadMessage returns the keypad message with runs of whitespace
+// collapsed into a single space, making it easier to match against.
+func (m Message) NormalizedKeypadMessage() string {
+	return strings.Join(strings.Fields(m.KeypadMessage), " ")
+}
+
+// ZoneNumber returns the zone number, decoding the zone code as base16 during
+// ECP bus failures and as base10 otherwise.
+func (m Message) ZoneNumber() (int, error) {
+	base := 10
+	if m.ZoneBusFailure {
+		base = 16
+	}
+
+	zone, err := strconv.ParseInt(m.Zone, base, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid zone %q", m.Zone)
+	}
+
+	return int(zone), nil
+}
+
+// String returns a human readable one-line summary of the message.
+func (m Message) String() string {
+	switch m.Type() {
+	case EventLRR:
+		return fmt.Sprintf("LRR event %q on partition %d (data %q)", m.LRR.EventType, m.LRR.Partition, m.LRR.EventData)
+	case EventRFX:
+		flags := []string{}
+		for i := 1; i <= 4; i++ {
+			if m.RFX.Loop(i) {
+				flags = append(flags, fmt.Sprintf("loop %d", i))
+			}
+		}
+
+		if m.RFX.LowBattery {
+			flags = append(flags, "low battery")
+		}
+
+		if m.RFX.Supervision {
+			flags = append(flags, "supervision")
+		}
+
+		return fmt.Sprintf("Wireless sensor %q (%s)", m.RFX.SerialNumber, strings.Join(flags, ", "))
+	case EventExpander:
+		return fmt.Sprintf("Expander %d channel %d is now %v", m.Expander.Address, m.Expander.Channel, m.Expander.State)
+	case EventRelay:
+		return fmt.Sprintf("Relay %d on module %d is now %v", m.Relay.Channel, m.Relay.Address, m.Relay.State)
+	case EventVersion:
+		return fmt.Sprintf("AlarmDecoder %s firmware %s (%s)", m.Version.SerialNumber, m.Version.Firmware, strings.Join(m.Version.Capabilities, ", "))
+	case EventAUI:
+		return fmt.Sprintf("AUI message %q", m.AUI.Data)
+	case EventUnknown:
+		return "Empty message"
+	}
+
+	flags := []string{}
+	for _, flag := range []struct {
+		name  string
+		value bool
+	}{
+		{"ready", m.Ready},
+		{"armed away", m.ArmedAway},
+		{"armed home", m.ArmedHome},
+		{"bypass", m.ZoneBypassed},
+		{"ac power", m.ACPower},
+		{"chime", m.ChimeEnabled},
+		{"alarm occurred", m.AlarmHasOccured},
+		{"alarm sounding", m.AlarmSounding},
+		{"battery low", m.BatteryLow},
+		{"fire", m.Fire},
+	} {
+		if flag.value {
+			flags = append(flags, flag.name)
+		}
+	}
+
+	return fmt.Sprintf("Keypad %q zone %s (%s)", m.KeypadMessage, m.Zone, strings.Join(flags, ", "))
+}
@@ -0,0 +1,232 @@
+package alarmdecoder
+
+import (
+	"fmt"
+)
+
+// Panel builds the keypress sequences for a type of panel. An empty code
+// uses the quick arming keys where supported.
+type Panel interface {
+	// ArmAway returns the keys arming the panel in away mode.
+	ArmAway(code string) string
+	// ArmHome returns the keys arming the panel in stay mode.
+	ArmHome(code string) string
+	// ArmNight returns the keys arming the panel in stay mode without entry delay.
+	ArmNight(code string) string
+	// Disarm returns the keys disarming the panel.
+	Disarm(code string) string
+	// Bypass returns the keys bypassing a zone.
+	Bypass(code string, zone int) string
+}
+
+// PanelForMode returns the panel matching the mode reported in keypad
+// messages, defaulting to Ademco.
+func PanelForMode(mode string) Panel {
+	if mode == "D" {
+		return DSCPanel{}
+	}
+
+	return AdemcoPanel{}
+}
+
+// Mode returns the panel mode, as last reported by a keypad message.
+func (ad *AlarmDecoder) Mode() string {
+	ad.modeLock.Lock()
+	defer ad.modeLock.Unlock()
+
+	return ad.mode
+}
+
+// SetMode overrides the panel mode, which is otherwise detected from the
+// keypad messages.
+func (ad *AlarmDecoder) SetMode(mode string) {
+	ad.modeLock.Lock()
+	defer ad.modeLock.Unlock()
+
+	ad.mode = mode
+}
+
+// ForceMode sets the panel mode, ignoring the mode reported by the keypad
+// messages from then on. An empty mode restores the detection.
+func (ad *AlarmDecoder) ForceMode(mode string) {
+	ad.modeLock.Lock()
+	defer ad.modeLock.Unlock()
+
+	ad.mode = mode
+	ad.modeForced = mode != ""
+}
+
+// detectMode records the panel mode reported by a keypad message, unless
+// forced.
+func (ad *AlarmDecoder) detectMode(mode string) {
+	ad.modeLock.Lock()
+	defer ad.modeLock.Unlock()
+
+	if !ad.modeForced {
+		ad.mode = mode
+	}
+}
+
+// Panel returns the keypress sequences of the panel in use.
+func (ad *AlarmDecoder) Panel() Panel {
+	return PanelForMode(ad.Mode())
+}
+
+// ArmAway arms the panel in away mode. An empty code quick arms.
+func (ad *AlarmDecoder) ArmAway(code string) error {
+	return ad.SendKeys(ad.Panel().ArmAway(code))
+}
+
+// ArmHome arms the panel in stay mode. An empty code quick arms.
+func (ad *AlarmDecoder) ArmHome(code string) error {
+	return ad.SendKeys(ad.Panel().ArmHome(code))
+}
+
+// ArmNight arms the panel in stay mode without entry delay. An empty code
+// quick arms.
+func (ad *AlarmDecoder) ArmNight(code string) error {
+	return ad.SendKeys(ad.Panel().ArmNight(code))
+}
+
+// Disarm disarms the panel.
+func (ad *AlarmDecoder) Disarm(code string) error {
+	return ad.SendKeys(ad.Panel().Disarm(code))
+}
+
+// Bypass bypasses a zone.
+func (ad *AlarmDecoder) Bypass(code string, zone int) error {
+	return ad.SendKeys(ad.Panel().Bypass(code, zone))
+}
+
+// Commander sends commands to the panel, either as the AlarmDecoder itself or
+// as one of the keypads it's emulating.
+type Commander interface {
+	// SendKeys sends a sequence of keypresses.
+	SendKeys(keys string) error
+	// ArmAway arms the panel in away mode.
+	ArmAway(code string) error
+	// ArmHome arms the panel in stay mode.
+	ArmHome(code string) error
+	// ArmNight arms the panel in stay mode without entry delay.
+	ArmNight(code string) error
+	// Disarm disarms the panel.
+	Disarm(code string) error
+	// Bypass bypasses a zone.
+	Bypass(code string, zone int) error
+}
+
+// Keypad sends commands as the keypad at a given address, for panels with
+// multiple partitions.
+type Keypad struct {
+	ad      *AlarmDecoder
+	address int
+}
+
+// Keypad returns the keypad at the given address, zero being the
+// AlarmDecoder's own address.
+func (ad *AlarmDecoder) Keypad(address int) *Keypad {
+	return &Keypad{ad: ad, address: address}
+}
+
+// SendKeys sends a sequence of keypresses from the keypad.
+func (k *Keypad) SendKeys(keys string) error {
+	if k.address == 0 {
+		return k.ad.SendKeys(keys)
+	}
+
+	return k.ad.SendAddressed(k.address, keys)
+}
+
+// ArmAway arms the panel in away mode. An empty code quick arms.
+func (k *Keypad) ArmAway(code string) error {
+	return k.SendKeys(k.ad.Panel().ArmAway(code))
+}
+
+// ArmHome arms the panel in stay mode. An empty code quick arms.
+func (k *Keypad) ArmHome(code string) error {
+	return k.SendKeys(k.ad.Panel().ArmHome(code))
+}
+
+// ArmNight arms the panel in stay mode without entry delay. An empty code
+// quick arms.
+func (k *Keypad) ArmNight(code string) error {
+	return k.SendKeys(k.ad.Panel().ArmNight(code))
+}
+
+// Disarm disarms the panel.
+func (k *Keypad) Disarm(code string) error {
+	return k.SendKeys(k.ad.Panel().Disarm(code))
+}
+
+// Bypass bypasses a zone.
+func (k *Keypad) Bypass(code string, zone int) error {
+	return k.SendKeys(k.ad.Panel().Bypass(code, zone))
+}
+
+// AdemcoPanel builds the keypress sequences for Ademco/Honeywell panels.
+type AdemcoPanel struct{}
+
+// ArmAway returns the keys arming the panel in away mode.
+func (AdemcoPanel) ArmAway(code string) string {
+	return ademcoCommand(code, "2")
+}
+
+// ArmHome returns the keys arming the panel in stay mode.
+func (AdemcoPanel) ArmHome(code string) string {
+	return ademcoCommand(code, "3")
+}
+
+// ArmNight returns the keys arming the panel in instant mode.
+func (AdemcoPanel) ArmNight(code string) string {
+	return ademcoCommand(code, "7")
+}
+
+// Disarm returns the keys disarming the panel.
+func (AdemcoPanel) Disarm(code string) string {
+	return code + "1"
+}
+
+// Bypass returns the keys bypassing a zone.
+func (AdemcoPanel) Bypass(code string, zone int) string {
+	return ademcoCommand(code, fmt.Sprintf("6%02d", zone))
+}
+
+// ademcoCommand prefixes a command with the code, or with # for the quick
+// version of the command.
+func ademcoCommand(code string, command string) string {
+	if code == "" {
+		return "#" + command
+	}
+
+	return code + command
+}
+
+// DSCPanel builds the keypress sequences for DSC panels.
+type DSCPanel struct{}
+
+// ArmAway returns the keys arming the panel in away mode, using the away
+// function key.
+func (DSCPanel) ArmAway(code string) string {
+	return "\x05\x05\x05"
+}
+
+// ArmHome returns the keys arming the panel in stay mode, using the stay
+// function key.
+func (DSCPanel) ArmHome(code string) string {
+	return "\x04\x04\x04"
+}
+
+// ArmNight returns the keys arming the panel without entry delay.
+func (DSCPanel) ArmNight(code string) string {
+	return "*9" + code
+}
+
+// Disarm returns the keys disarming the panel.
+func (DSCPanel) Disarm(code string) string {
+	return code
+}
+
+// Bypass returns the keys bypassing a zone.
+func (DSCPanel) Bypass(code string, zone int) string {
+	return fmt.Sprintf("*1%s%02d#", code, zone)
+}
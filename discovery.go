@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// deviceConfig is the Home Assistant device all entities are grouped under.
+type deviceConfig struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+}
+
+// alarmPanelConfig is the Home Assistant discovery configuration of an alarm panel.
+type alarmPanelConfig struct {
+	AvailabilityTopic   string       `json:"availability_topic"`
+	Code                string       `json:"code,omitempty"`
+	CodeArmRequired     bool         `json:"code_arm_required"`
+	CodeDisarmRequired  bool         `json:"code_disarm_required"`
+	CodeTriggerRequired bool         `json:"code_trigger_required"`
+	CommandTemplate     string       `json:"command_template,omitempty"`
+	CommandTopic        string       `json:"command_topic,omitempty"`
+	Device              deviceConfig `json:"device"`
+	JSONAttributesTopic string       `json:"json_attributes_topic"`
+	Name                string       `json:"name"`
+	StateTopic          string       `json:"state_topic"`
+	SupportedFeatures   []string     `json:"supported_features"`
+	UniqueID            string       `json:"unique_id"`
+}
+
+// binarySensorConfig is the Home Assistant discovery configuration of a binary sensor.
+type binarySensorConfig struct {
+	AvailabilityTopic   string       `json:"availability_topic"`
+	Device              deviceConfig `json:"device"`
+	UniqueID            string       `json:"unique_id"`
+	Name                string       `json:"name"`
+	StateTopic          string       `json:"state_topic"`
+	JSONAttributesTopic string       `json:"json_attributes_topic,omitempty"`
+	PayloadOn           string       `json:"payload_on"`
+	PayloadOff          string       `json:"payload_off"`
+	DeviceClass         string       `json:"device_class,omitempty"`
+	EntityCategory      string       `json:"entity_category,omitempty"`
+}
+
+// deviceTriggerConfig is the Home Assistant discovery configuration of a
+// device trigger.
+type deviceTriggerConfig struct {
+	AutomationType string       `json:"automation_type"`
+	Device         deviceConfig `json:"device"`
+	Payload        string       `json:"payload"`
+	Topic          string       `json:"topic"`
+	Type           string       `json:"type"`
+	Subtype        string       `json:"subtype"`
+}
+
+// sensorConfig is the Home Assistant discovery configuration of a sensor.
+type sensorConfig struct {
+	AvailabilityTopic string       `json:"availability_topic"`
+	Device            deviceConfig `json:"device"`
+	UniqueID          string       `json:"unique_id"`
+	Name              string       `json:"name"`
+	StateTopic        string       `json:"state_topic"`
+	Icon              string       `json:"icon,omitempty"`
+	UnitOfMeasurement string       `json:"unit_of_measurement,omitempty"`
+	EntityCategory    string       `json:"entity_category,omitempty"`
+}
+
+// panelConfig returns the discovery configuration of a partition's alarm panel.
+func (b *bridge) panelConfig(p *partition) alarmPanelConfig {
+	name := b.deviceID
+	if p.id != 0 {
+		name = fmt.Sprintf("%s partition %d", b.deviceID, p.id)
+	}
+
+	config := alarmPanelConfig{
+		AvailabilityTopic:   b.availabilityTopic(),
+		Code:                b.code,
+		CodeArmRequired:     b.codeArmRequired,
+		CodeDisarmRequired:  b.codeDisarmRequired,
+		CodeTriggerRequired: b.codeTriggerRequired,
+		Device:              b.device,
+		JSONAttributesTopic: b.partitionTopic(p, "attributes"),
+		Name:                name,
+		StateTopic:          b.partitionTopic(p, "state"),
+		SupportedFeatures:   []string{},
+		UniqueID:            b.partitionUniqueID(p),
+	}
+
+	// Read-only bridges don't take commands.
+	if !b.readOnly {
+		config.CommandTemplate = `{"action": "{{ action }}", "code": "{{ code }}"}`
+		config.CommandTopic = b.partitionTopic(p, "command")
+
+		for _, action := range b.armActions {
+			config.SupportedFeatures = append(config.SupportedFeatures, strings.ToLower(action))
+		}
+	}
+
+	return config
+}
+
+// zoneConfig returns the discovery configuration of a zone.
+func (b *bridge) zoneConfig(zone zone) binarySensorConfig {
+	config := binarySensorConfig{
+		AvailabilityTopic: b.availabilityTopic(),
+		Device:            b.device,
+		UniqueID:          zone.Name,
+		Name:              zone.FriendlyName,
+		StateTopic:        b.zoneTopic(zone, "state"),
+		PayloadOn:         zone.payloadOn(),
+		PayloadOff:        zone.payloadOff(),
+		DeviceClass:       zone.Type,
+	}
+
+	if b.zoneAttributes {
+		config.JSONAttributesTopic = b.zoneTopic(zone, "attributes")
+	}
+
+	return config
+}
+
+// zoneTriggerConfig returns the discovery configuration of a zone published
+// as a device trigger.
+func (b *bridge) zoneTriggerConfig(zone zone) deviceTriggerConfig {
+	subtype := zone.FriendlyName
+	if subtype == "" {
+		subtype = zone.Name
+	}
+
+	return deviceTriggerConfig{
+		AutomationType: "trigger",
+		Device:         b.device,
+		Payload:        zone.payloadOn(),
+		Topic:          b.zoneTopic(zone, "trigger"),
+		Type:           "zone_triggered",
+		Subtype:        subtype,
+	}
+}
+
+// panelBinarySensorConfig returns the discovery configuration of a panel binary sensor.
+func (b *bridge) panelBinarySensorConfig(sensor binarySensor) binarySensorConfig {
+	config := binarySensorConfig{
+		AvailabilityTopic: b.availabilityTopic(),
+		Device:            b.device,
+		UniqueID:          fmt.Sprintf("%s_%s", b.deviceID, sensor.id),
+		Name:              sensor.name,
+		StateTopic:        b.sensorTopic("binary_sensor", sensor.id, "state"),
+		PayloadOn:         "on",
+		PayloadOff:        "off",
+		DeviceClass:       sensor.deviceClass,
+	}
+
+	if sensor.diagnostic {
+		config.EntityCategory = "diagnostic"
+	}
+
+	return config
+}
+
+// panelSensorConfig returns the discovery configuration of a panel sensor.
+func (b *bridge) panelSensorConfig(sensor sensor) sensorConfig {
+	config := sensorConfig{
+		AvailabilityTopic: b.availabilityTopic(),
+		Device:            b.device,
+		UniqueID:          fmt.Sprintf("%s_%s", b.deviceID, sensor.id),
+		Name:              sensor.name,
+		StateTopic:        b.sensorTopic("sensor", sensor.id, "state"),
+		Icon:              sensor.icon,
+		UnitOfMeasurement: sensor.unit,
+	}
+
+	if sensor.diagnostic {
+		config.EntityCategory = "diagnostic"
+	}
+
+	return config
+}
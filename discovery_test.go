@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+func TestZoneConfigEscaping(t *testing.T) {
+	b, client := newTestBridge(map[string]zone{
+		"005": {Name: "kitchen_door", FriendlyName: `Kitchen "Back" Door`, Type: "door"},
+	})
+
+	err := b.publishZoneConfig(b.zones["005"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := client.published["homeassistant/binary_sensor/kitchen_door/config"]
+	if !json.Valid([]byte(data)) {
+		t.Fatalf("invalid JSON config: %s", data)
+	}
+
+	var config binarySensorConfig
+	err = json.Unmarshal([]byte(data), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Name != `Kitchen "Back" Door` {
+		t.Errorf("got name %q; wanted %q", config.Name, `Kitchen "Back" Door`)
+	}
+
+	if config.StateTopic != "homeassistant/binary_sensor/kitchen_door/state" {
+		t.Errorf("got state topic %q", config.StateTopic)
+	}
+}
+
+func TestDiagnosticSensors(t *testing.T) {
+	b, client := newTestBridge(nil)
+
+	err := b.handleMessage(alarmdecoder.Message{ProgrammingMode: true, Beeps: 3, UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := client.get("homeassistant/sensor/ad2mqtt/beeps/state"); value != "3" {
+		t.Errorf("got beeps %q; wanted %q", value, "3")
+	}
+
+	if value, _ := client.get("homeassistant/binary_sensor/ad2mqtt/programming/state"); value != "on" {
+		t.Errorf("got programming mode %q; wanted %q", value, "on")
+	}
+
+	for _, sensor := range binarySensors {
+		if sensor.id != "programming" {
+			continue
+		}
+
+		config := b.panelBinarySensorConfig(sensor)
+		if config.DeviceClass != "problem" || config.EntityCategory != "diagnostic" {
+			t.Errorf("got device class %q and category %q for programming mode", config.DeviceClass, config.EntityCategory)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+// zoneFlapping records a state change of a zone, returning whether the zone
+// is flapping in which case the change shouldn't be published. A zone is
+// flapping when it changed state more than the threshold within the window,
+// its state gets published again once it stayed stable for a whole window.
+// The caller must hold the lock.
+func (b *bridge) zoneFlapping(k string, zone zone) (bool, error) {
+	if b.flapThreshold <= 0 {
+		return false, nil
+	}
+
+	now := b.clock.Now()
+	flips := append(b.zoneFlips[k], now)
+	for len(flips) > 0 && now.Sub(flips[0]) > b.flapWindow {
+		flips = flips[1:]
+	}
+
+	b.zoneFlips[k] = flips
+
+	timer, flapping := b.flappingZones[k]
+	if !flapping && len(flips) <= b.flapThreshold {
+		return false, nil
+	}
+
+	if flapping {
+		timer.Stop()
+	} else {
+		logWarnf("[alarm] Zone %q is flapping, holding its state until it settles", zone.Name)
+	}
+
+	var settle alarmdecoder.Timer
+	settle = b.clock.AfterFunc(b.flapWindow, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		if b.flappingZones[k] != settle {
+			return
+		}
+
+		delete(b.flappingZones, k)
+		delete(b.zoneFlips, k)
+
+		zone, ok := b.zones[k]
+		if !ok {
+			return
+		}
+
+		logInfof("[alarm] Zone %q stopped flapping", zone.Name)
+
+		// The state goes through the throttle which is used for the changes.
+		var err error
+		if !zone.isTrigger() {
+			err = b.publishThrottled(b.zoneTopic(zone, "state"), zone.payload(zoneFaulted(k, zone, b.zoneState)))
+		}
+
+		if err != nil {
+			logErrorf("[mqtt] Failed to publish the state of zone %q: %v", zone.Name, err)
+		}
+
+		err = b.updateFlappingSensor()
+		if err != nil {
+			logErrorf("[mqtt] Failed to publish the flapping zones: %v", err)
+		}
+	})
+
+	b.flappingZones[k] = settle
+
+	return true, b.updateFlappingSensor()
+}
+
+// updateFlappingSensor publishes the names of the flapping zones. The caller
+// must hold the lock.
+func (b *bridge) updateFlappingSensor() error {
+	names := []string{}
+	for k := range b.flappingZones {
+		names = append(names, b.zones[k].Name)
+	}
+
+	sort.Strings(names)
+
+	return b.setSensorState("sensor", flappingZonesSensor.id, strings.Join(names, ", "))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// startHTTP starts the HTTP server exposing the health endpoints and metrics.
+func (b *bridge) startHTTP(address string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", b.handleHealthz)
+	mux.HandleFunc("/readyz", b.handleReadyz)
+	mux.HandleFunc("/metrics", b.handleMetrics)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on %q: %w", address, err)
+	}
+
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil {
+			logErrorf("[http] Failed to serve HTTP: %v", err)
+		}
+	}()
+
+	logInfof("[http] Listening on %s", listener.Addr())
+
+	return nil
+}
+
+// handleHealthz reports whether the bridge is connected to MQTT and still
+// receiving messages from the alarm.
+func (b *bridge) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	b.lock.Lock()
+	commLost := b.commLost
+	b.lock.Unlock()
+
+	if !b.mqttClient.IsConnected() {
+		http.Error(w, "MQTT disconnected", http.StatusServiceUnavailable)
+		return
+	}
+
+	if commLost {
+		http.Error(w, "No message received from the alarm", http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "OK")
+}
+
+// handleReadyz reports whether the bridge is done starting up and has
+// received a message from the alarm.
+func (b *bridge) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	b.lock.Lock()
+	ready := b.mqttReady && !b.lastMessage.IsZero()
+	b.lock.Unlock()
+
+	if !ready {
+		http.Error(w, "Not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "OK")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	b, _ := newTestBridge(nil)
+
+	status := func(handler http.HandlerFunc) int {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+
+	if status(b.handleHealthz) != http.StatusOK {
+		t.Errorf("expected healthz to succeed")
+	}
+
+	// Not ready until set up and a message was received.
+	if status(b.handleReadyz) != http.StatusServiceUnavailable {
+		t.Errorf("expected readyz to fail before startup")
+	}
+
+	b.mqttReady = true
+	err := b.handleMessage(alarmdecoder.Message{Ready: true, UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status(b.handleReadyz) != http.StatusOK {
+		t.Errorf("expected readyz to succeed")
+	}
+
+	// Losing the alarm makes the bridge unhealthy.
+	b.commLost = true
+	if status(b.handleHealthz) != http.StatusServiceUnavailable {
+		t.Errorf("expected healthz to fail after communication loss")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	b, _ := newTestBridge(map[string]zone{"005": {Name: "door"}})
+
+	err := b.handleMessage(alarmdecoder.Message{Zone: "005", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.metrics.messageParsed()
+	b.metrics.commandSent("ARM_AWAY")
+
+	rec := httptest.NewRecorder()
+	b.handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range []string{
+		"ad2mqtt_messages_total 1\n",
+		"ad2mqtt_commands_total{action=\"ARM_AWAY\"} 1\n",
+		"ad2mqtt_alarm_state{partition=\"0\",state=\"disarmed\"} 1\n",
+		"ad2mqtt_alarm_state{partition=\"0\",state=\"pending\"} 0\n",
+		"ad2mqtt_faulted_zones 1\n",
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("missing %q in metrics:\n%s", line, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Log levels, in increasing order of severity.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[string]int{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// logLevel is the minimum level of the messages getting logged.
+var logLevel = levelInfo
+
+// setLogLevel sets the minimum level of the messages getting logged.
+func setLogLevel(name string) error {
+	level, ok := levelNames[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("Invalid log level %q", name)
+	}
+
+	logLevel = level
+
+	return nil
+}
+
+// logf logs a message if its level is enabled.
+func logf(level int, format string, args ...interface{}) {
+	if level < logLevel {
+		return
+	}
+
+	log.Printf(format, args...)
+}
+
+// logDebugf logs a debug message.
+func logDebugf(format string, args ...interface{}) {
+	logf(levelDebug, format, args...)
+}
+
+// logInfof logs an informational message.
+func logInfof(format string, args ...interface{}) {
+	logf(levelInfo, format, args...)
+}
+
+// logWarnf logs a warning.
+func logWarnf(format string, args ...interface{}) {
+	logf(levelWarn, format, args...)
+}
+
+// logErrorf logs an error.
+func logErrorf(format string, args ...interface{}) {
+	logf(levelError, format, args...)
+}
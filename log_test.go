@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer func() { logLevel = levelInfo }()
+
+	err := setLogLevel("WARN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logInfof("info")
+	logWarnf("warn")
+	if bytes.Contains(buf.Bytes(), []byte("info")) || !bytes.Contains(buf.Bytes(), []byte("warn")) {
+		t.Errorf("unexpected output at warn level: %q", buf.String())
+	}
+
+	err = setLogLevel("verbose")
+	if err == nil {
+		t.Errorf("setLogLevel(%q) should have failed", "verbose")
+	}
+}
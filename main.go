@@ -1,29 +1,33 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/stgraber/ad2mqtt/decoder"
 
 	"github.com/eclipse/paho.mqtt.golang"
-	"github.com/jacobsa/go-serial/serial"
 )
 
-type zone struct {
-	Name         string `json:"name"`
-	FriendlyName string `json:"friendly_name"`
-	Type         string `json:"type"`
-	Disabled     bool   `json:"disabled"`
-}
-
 func main() {
 	log.SetOutput(os.Stdout)
 
-	err := run()
+	err := parseFlags(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	err = run()
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
@@ -31,205 +35,417 @@ func main() {
 }
 
 func run() error {
+	err := setLogLevel(getEnv("LOG_LEVEL", "info"))
+	if err != nil {
+		return err
+	}
+
 	// Load the zones.
-	content, err := ioutil.ReadFile(os.Getenv("CONFIG"))
+	zones, err := loadZones(lookupEnv("CONFIG"))
 	if err != nil {
-		return fmt.Errorf("Failed to load the config: %w", err)
+		return err
 	}
 
-	var zones map[string]zone
-	err = json.Unmarshal(content, &zones)
+	err = validateZones(zones)
 	if err != nil {
-		return fmt.Errorf("Failed to unmarshal the config: %w", err)
+		return err
 	}
 
-	// Setup serial connection.
-	options := serial.OpenOptions{
-		PortName:        os.Getenv("AD_PATH"),
-		BaudRate:        115200,
-		DataBits:        8,
-		StopBits:        1,
-		MinimumReadSize: 4,
+	deviceID := getEnv("DEVICE_ID", "ad2mqtt")
+	b := &bridge{
+		discoveryPrefix: getEnv("DISCOVERY_PREFIX", "homeassistant"),
+		deviceID:        deviceID,
+		device: deviceConfig{
+			Identifiers:  []string{deviceID},
+			Name:         getEnv("DEVICE_NAME", "AD2 Alarm"),
+			Manufacturer: getEnv("DEVICE_MANUFACTURER", "NuTech"),
+			Model:        getEnv("DEVICE_MODEL", "AlarmDecoder"),
+		},
+
+		code: getEnv("ALARM_CODE", "REMOTE_CODE"),
+
+		armActions:         getEnvList("ARM_ACTIONS", []string{"ARM_HOME", "ARM_AWAY", "ARM_NIGHT"}),
+		armIgnoredTypes:    getEnvList("ARM_IGNORED_ZONE_TYPES", []string{"motion", "occupancy", "presence"}),
+		exitDelayPatterns:  getEnvList("EXIT_DELAY_PATTERNS", []string{"EXIT NOW", "EXIT DELAY"}),
+		entryDelayPatterns: getEnvList("ENTRY_DELAY_PATTERNS", []string{"DISARM SYSTEM", "ENTRY DELAY"}),
+		troublePatterns:    getEnvList("TROUBLE_PATTERNS", []string{"CHECK", "TRBL", "TROUBLE"}),
+		keyTemplates: map[string]string{
+			"ARM_HOME":  lookupEnv("ARM_HOME_KEYS"),
+			"ARM_AWAY":  lookupEnv("ARM_AWAY_KEYS"),
+			"ARM_NIGHT": lookupEnv("ARM_NIGHT_KEYS"),
+			"DISARM":    lookupEnv("DISARM_KEYS"),
+		},
+
+		// The AlarmDecoder sends the A, B and C keys (1+*, *+# and 3+#)
+		// when receiving the matching control character three times.
+		panicKeys: map[string]string{
+			"PANIC_FIRE":   getEnv("PANIC_FIRE_KEYS", "\x01\x01\x01"),
+			"PANIC_POLICE": getEnv("PANIC_POLICE_KEYS", "\x02\x02\x02"),
+			"PANIC_AUX":    getEnv("PANIC_AUX_KEYS", "\x03\x03\x03"),
+		},
+
+		clock: alarmdecoder.RealClock,
+
+		zones:        zones,
+		zoneState:    map[string]bool{},
+		faultCycle:   map[string]bool{},
+		troubleZones: map[string]bool{},
+		sensorState:  map[string]string{},
+
+		zoneFaultedAt:   map[string]time.Time{},
+		zoneTriggeredAt: map[string]time.Time{},
+		zoneFlips:       map[string][]time.Time{},
+		flappingZones:   map[string]alarmdecoder.Timer{},
+		stateFile:       lookupEnv("STATE_FILE"),
 	}
 
-	port, err := serial.Open(options)
+	b.keyDelay, err = getEnvDuration("KEY_DELAY", alarmdecoder.DefaultKeyDelay)
 	if err != nil {
-		return fmt.Errorf("Failed to open serial port: %w", err)
+		return err
 	}
-	defer port.Close()
 
-	// Setup alarm decoder.
-	ad := alarmdecoder.New(port)
+	b.codeLength, err = getEnvInt("CODE_LENGTH", 4)
+	if err != nil {
+		return err
+	}
 
-	// Setup MQTT connection.
-	mqttOpts := mqtt.NewClientOptions()
-	mqttOpts.AddBroker(os.Getenv("MQTT_HOST"))
-	mqttOpts.SetClientID("ad2mqtt")
-	mqttOpts.SetUsername(os.Getenv("MQTT_USERNAME"))
-	mqttOpts.SetPassword(os.Getenv("MQTT_PASSWORD"))
-	mqttOpts.SetAutoReconnect(true)
-	mqttOpts.SetCleanSession(false)
-	mqttClient := mqtt.NewClient(mqttOpts)
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		return token.Error()
+	b.codeArmRequired, err = getEnvBool("CODE_ARM_REQUIRED", false)
+	if err != nil {
+		return err
 	}
 
-	// Setup MQTT topics.
-	data := `{
-    "code": "REMOTE_CODE",
-    "code_arm_required": false,
-    "code_disarm_required": true,
-    "code_trigger_required": false,
-    "command_template": "{\"action\": \"{{ action }}\", \"code\": \"{{ code }}\"}",
-    "command_topic": "homeassistant/alarm_control_panel/ad2mqtt/command",
-    "name": "ad2mqtt",
-    "state_topic": "homeassistant/alarm_control_panel/ad2mqtt/state"
-}`
-	if token := mqttClient.Publish("homeassistant/alarm_control_panel/ad2mqtt/config", 0, true, data); token.Wait() && token.Error() != nil {
-		return token.Error()
-	}
-
-	mqttCallback := func(client mqtt.Client, msg mqtt.Message) {
-		value := msg.Payload()
-
-		type mqttAction struct {
-			Action string `json:"action"`
-			Code   string `json:"code"`
+	b.codeDisarmRequired, err = getEnvBool("CODE_DISARM_REQUIRED", true)
+	if err != nil {
+		return err
+	}
+
+	b.codeTriggerRequired, err = getEnvBool("CODE_TRIGGER_REQUIRED", false)
+	if err != nil {
+		return err
+	}
+
+	for action, template := range b.keyTemplates {
+		if template == "" {
+			continue
 		}
 
-		var action mqttAction
-		err := json.Unmarshal(value, &action)
+		codeRequired := b.codeArmRequired
+		if action == "DISARM" {
+			codeRequired = b.codeDisarmRequired
+		}
+
+		err = validateKeyTemplate(action, template, codeRequired)
 		if err != nil {
-			log.Printf("[mqtt] Failed to parse action: %v", err)
+			return err
 		}
+	}
 
-		if action.Action == "ARM_HOME" {
-			ad.Write([]byte("#"))
-			ad.Write([]byte("3"))
+	// Detection of the panel mode can be overridden.
+	b.mode = lookupEnv("PANEL_MODE")
+	if b.mode != "" && b.mode != "A" && b.mode != "D" {
+		return fmt.Errorf("Invalid value for PANEL_MODE: %q", b.mode)
+	}
 
-			log.Printf("[mqtt] Armed (home)")
-		} else if action.Action == "ARM_AWAY" {
-			ad.Write([]byte("#"))
-			ad.Write([]byte("2"))
+	b.modeForced = b.mode != ""
 
-			log.Printf("[mqtt] Armed (away)")
-		} else if action.Action == "DISARM" {
-			if action.Code == "None" {
-				log.Printf("[mqtt] Failed to disarm: No code provided")
-				return
-			}
+	for _, action := range b.armActions {
+		if !stringInSlice(action, []string{"ARM_HOME", "ARM_AWAY", "ARM_NIGHT"}) {
+			return fmt.Errorf("Invalid value for ARM_ACTIONS: %q", action)
+		}
+	}
 
-			for _, c := range action.Code {
-				ad.Write([]byte(string(c)))
-			}
-			ad.Write([]byte("1"))
+	b.panelEnabled, err = getEnvBool("ENABLE_PANEL", true)
+	if err != nil {
+		return err
+	}
 
-			log.Printf("[mqtt] Disarmed")
-		}
+	b.panicEnabled, err = getEnvBool("ENABLE_PANIC", false)
+	if err != nil {
+		return err
 	}
 
-	if token := mqttClient.Subscribe("homeassistant/alarm_control_panel/ad2mqtt/command", 0, mqttCallback); token.Wait() && token.Error() != nil {
-		return token.Error()
+	b.autoDiscoverZones, err = getEnvBool("AUTO_DISCOVER_ZONES", false)
+	if err != nil {
+		return err
 	}
 
-	for _, zone := range zones {
-		if zone.Disabled || zone.Name == "" {
-			continue
-		}
+	b.discoveryTemplate = getEnv("AUTO_DISCOVER_ZONE_NAME", "Zone {zone}")
+	b.discoveryType = lookupEnv("AUTO_DISCOVER_ZONE_TYPE")
+	if b.discoveryType != "" && !stringInSlice(b.discoveryType, binarySensorDeviceClasses) {
+		return fmt.Errorf("Invalid value for AUTO_DISCOVER_ZONE_TYPE: %q", b.discoveryType)
+	}
 
-		// Define the sensor.
-		data := fmt.Sprintf(`{
-    "unique_id": "%s",
-    "name": "%s",
-    "state_topic": "homeassistant/binary_sensor/%s/state",
-    "payload_on": "on",
-    "payload_off": "off",
-    "device_class": "%s"
-}`, zone.Name, zone.FriendlyName, zone.Name, zone.Type)
-		if token := mqttClient.Publish(fmt.Sprintf("homeassistant/binary_sensor/%s/config", zone.Name), 0, true, data); token.Wait() && token.Error() != nil {
-			return token.Error()
-		}
+	b.publishParseErrors, err = getEnvBool("PUBLISH_PARSE_ERRORS", false)
+	if err != nil {
+		return err
+	}
 
-		if token := mqttClient.Publish(fmt.Sprintf("homeassistant/binary_sensor/%s/state", zone.Name), 0, true, "off"); token.Wait() && token.Error() != nil {
-			return token.Error()
-		}
+	b.zoneAttributes, err = getEnvBool("ZONE_ATTRIBUTES", false)
+	if err != nil {
+		return err
+	}
+
+	b.flapThreshold, err = getEnvInt("FLAP_THRESHOLD", 0)
+	if err != nil {
+		return err
+	}
 
+	b.flapWindow, err = getEnvDuration("FLAP_WINDOW", time.Minute)
+	if err != nil {
+		return err
 	}
 
-	// Process incoming message.
-	alarmState := ""
-	zoneState := map[string]bool{}
-	for {
-		msg, err := ad.Read()
+	if b.flapThreshold < 0 || (b.flapThreshold > 0 && b.flapWindow <= 0) {
+		return fmt.Errorf("Invalid value for FLAP_THRESHOLD: Must be positive with a positive FLAP_WINDOW")
+	}
+
+	b.removeOnShutdown, err = getEnvBool("CLEANUP_ON_SHUTDOWN", false)
+	if err != nil {
+		return err
+	}
+
+	b.confirmTimeout, err = getEnvDuration("COMMAND_CONFIRM_TIMEOUT", 0)
+	if err != nil {
+		return err
+	}
+
+	b.refreshWindow, err = getEnvDuration("REFRESH_FAULTS_WINDOW", 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	b.clearDelay, err = getEnvDuration("CLEAR_DELAY", time.Second)
+	if err != nil {
+		return err
+	}
+
+	b.commandDebounce, err = getEnvDuration("COMMAND_DEBOUNCE", 2*time.Second)
+	if err != nil {
+		return err
+	}
+
+	publishInterval, err := getEnvDuration("PUBLISH_INTERVAL", time.Second)
+	if err != nil {
+		return err
+	}
+
+	b.throttle = newThrottle(publishInterval)
+
+	b.partitions, err = parsePartitions(getEnvList("PARTITIONS", nil))
+	if err != nil {
+		return err
+	}
+
+	// Restore the state from before the last restart.
+	b.loadState()
+
+	b.dryRun, err = getEnvBool("DRY_RUN", false)
+	if err != nil {
+		return err
+	}
+
+	if b.dryRun {
+		logWarnf("[alarm] Dry run mode enabled, nothing will be sent to the panel")
+	}
+
+	b.readOnly, err = getEnvBool("READ_ONLY", false)
+	if err != nil {
+		return err
+	}
+
+	if b.readOnly {
+		logWarnf("[alarm] Read-only mode enabled, commands are disabled")
+	}
+
+	// Setup the connection.
+	b.port, err = openPort(b.dryRun)
+	if err != nil {
+		return err
+	}
+	defer func() { b.port.Close() }()
+
+	// Setup alarm decoder.
+	b.ad = b.newDecoder(b.port)
+
+	// Log the AlarmDecoder version for support purposes.
+	if !b.readOnly {
+		err = b.ad.RequestVersion()
 		if err != nil {
-			log.Printf("[alarm] Unknown message from alarm: %v", err)
-			continue
+			logWarnf("[alarm] Failed to request the AlarmDecoder version: %v", err)
 		}
+	}
+
+	// Setup MQTT connection.
+	b.qos, err = getEnvQoS("MQTT_QOS", 0)
+	if err != nil {
+		return err
+	}
+
+	b.commandQoS, err = getEnvQoS("MQTT_COMMAND_QOS", 0)
+	if err != nil {
+		return err
+	}
+
+	b.retain, err = getEnvBool("MQTT_RETAIN", true)
+	if err != nil {
+		return err
+	}
+
+	username, err := lookupSecret("MQTT_USERNAME")
+	if err != nil {
+		return err
+	}
+
+	password, err := lookupSecret("MQTT_PASSWORD")
+	if err != nil {
+		return err
+	}
+
+	// The client ID defaults to the device ID so multiple bridges don't
+	// kick each other off the broker.
+	clientID := getEnv("MQTT_CLIENT_ID", deviceID)
+
+	// Persistent sessions have the broker queue the commands received while
+	// briefly disconnected.
+	cleanSession, err := getEnvBool("MQTT_CLEAN_SESSION", false)
+	if err != nil {
+		return err
+	}
+
+	mqttOpts := mqtt.NewClientOptions()
+	mqttOpts.SetClientID(clientID)
+	mqttOpts.SetUsername(username)
+	mqttOpts.SetPassword(password)
+	mqttOpts.SetAutoReconnect(true)
+	mqttOpts.SetCleanSession(cleanSession)
+	mqttOpts.SetWill(b.availabilityTopic(), "offline", b.qos, true)
 
-		// Update the alarm state.
-		var newAlarmState string
-		if msg.AlarmSounding || msg.AlarmHasOccured {
-			newAlarmState = "triggered"
-		} else if msg.ArmedHome {
-			newAlarmState = "armed_home"
-		} else if msg.ArmedAway {
-			newAlarmState = "armed_away"
-		} else if !msg.Ready {
-			newAlarmState = "pending"
-		} else {
-			newAlarmState = "disarmed"
+	tlsConfig, err := mqttTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	broker := lookupEnv("MQTT_HOST")
+	if tlsConfig != nil {
+		mqttOpts.SetTLSConfig(tlsConfig)
+
+		// The MQTT client only uses TLS for TLS schemes.
+		if strings.HasPrefix(broker, "tcp://") {
+			broker = "ssl://" + strings.TrimPrefix(broker, "tcp://")
 		}
+	}
 
-		if newAlarmState != alarmState {
-			alarmState = newAlarmState
-			if token := mqttClient.Publish("homeassistant/alarm_control_panel/ad2mqtt/state", 0, true, alarmState); token.Wait() && token.Error() != nil {
-				return token.Error()
-			}
+	mqttOpts.AddBroker(broker)
+
+	mqttOpts.SetOnConnectHandler(b.handleConnect)
+	b.mqttClient = mqtt.NewClient(mqttOpts)
+
+	connectTimeout, err := getEnvDuration("MQTT_CONNECT_TIMEOUT", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	err = b.connectMQTT(connectTimeout)
+	if err != nil {
+		return err
+	}
+
+	// Setup MQTT topics.
+	err = b.setupMQTT()
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	b.mqttReady = true
+	b.lock.Unlock()
+
+	// Detect communication loss with the panel.
+	watchdogTimeout, err := getEnvDuration("WATCHDOG_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return err
+	}
+
+	b.startWatchdog(watchdogTimeout)
+
+	// Drop repeated messages.
+	b.filterDuplicates, err = getEnvBool("FILTER_DUPLICATES", false)
+	if err != nil {
+		return err
+	}
 
-			log.Printf("[alarm] Set state to %s", alarmState)
+	b.duplicateInterval, err = getEnvDuration("DUPLICATE_INTERVAL", 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	if b.filterDuplicates && watchdogTimeout > 0 && b.duplicateInterval >= watchdogTimeout {
+		return fmt.Errorf("Invalid value for DUPLICATE_INTERVAL: Must be shorter than WATCHDOG_TIMEOUT")
+	}
+
+	// Serve the health endpoints and metrics.
+	httpListen := lookupEnv("HTTP_LISTEN")
+	if httpListen != "" {
+		err = b.startHTTP(httpListen)
+		if err != nil {
+			return err
 		}
+	}
 
-		// Handle zone triggers.
-		zone, ok := zones[msg.Zone]
-		if !ok {
-			log.Printf("[alarm] Unknown zone %q has been triggered", msg.Zone)
+	// Reload the zones on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			err := b.reloadZones(lookupEnv("CONFIG"))
+			if err != nil {
+				logErrorf("[alarm] Failed to reload the zones: %v", err)
+			}
 		}
+	}()
 
-		if !zone.Disabled {
-			state := zoneState[zone.Name]
-			if !state {
-				if token := mqttClient.Publish(fmt.Sprintf("homeassistant/binary_sensor/%s/state", zone.Name), 0, true, "on"); token.Wait() && token.Error() != nil {
-					return token.Error()
-				}
+	// Stop cleanly on SIGINT/SIGTERM.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-				log.Printf("[alarm] Zone %q has been triggered", zone.Name)
-				zoneState[msg.Zone] = true
+	// Process incoming message.
+	for {
+		msg, err := b.ad.ReadContext(ctx)
+		if ctx.Err() != nil {
+			logInfof("[alarm] Shutting down")
+			return b.shutdown()
+		} else if err != nil && isConnectionError(err) {
+			logWarnf("[alarm] Lost connection to alarm: %v", err)
+			err = b.reconnect(ctx)
+			if err != nil {
+				logInfof("[alarm] Shutting down")
+				return b.shutdown()
 			}
-		}
 
-		// Once things are quiet, look for any formerly triggered zone.
-		if msg.Ready {
-			for k, v := range zoneState {
-				if k == msg.Zone {
-					continue
-				}
-
-				if !v {
-					continue
-				}
-
-				zoneState[k] = false
-				zone := zones[k]
-				if zone.Name != "" {
-					if token := mqttClient.Publish(fmt.Sprintf("homeassistant/binary_sensor/%s/state", zone.Name), 0, true, "off"); token.Wait() && token.Error() != nil {
-						return token.Error()
-					}
-
-					log.Printf("[alarm] Zone %q has been cleared", zone.Name)
-				}
+			// Make sure Home Assistant didn't miss anything while disconnected.
+			err = b.republish()
+			if err != nil {
+				logErrorf("[mqtt] Failed to republish after reconnecting: %v", err)
+				b.stale = true
 			}
+
+			continue
+		} else if err != nil {
+			var parseErr *alarmdecoder.ParseError
+			if errors.As(err, &parseErr) {
+				logWarnf("[alarm] Ignoring malformed message %q, invalid %s: %v", parseErr.Line, parseErr.Field, parseErr.Err)
+			} else {
+				logWarnf("[alarm] Unknown message from alarm: %v", err)
+			}
+
+			b.metrics.parseFailed()
+			b.publishParseError(err)
+			continue
 		}
-	}
 
-	return nil
+		logDebugf("[alarm] Received %q: %s", msg.UnparsedMessage, msg)
+		b.metrics.messageParsed()
+
+		b.processMessage(msg)
+	}
 }
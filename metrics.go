@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// alarmStates are the alarm states reported by the bridge.
+var alarmStates = []string{"disarmed", "arming", "pending", "armed_home", "armed_away", "armed_night", "triggered"}
+
+// metrics tracks the counters exposed in the Prometheus format.
+type metrics struct {
+	lock sync.Mutex
+
+	messages        uint64
+	parseErrors     uint64
+	publishFailures uint64
+	commands        map[string]uint64
+}
+
+// messageParsed counts a message successfully parsed.
+func (m *metrics) messageParsed() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.messages++
+}
+
+// parseFailed counts a message which couldn't be parsed.
+func (m *metrics) parseFailed() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.parseErrors++
+}
+
+// publishFailed counts a failed MQTT publish.
+func (m *metrics) publishFailed() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.publishFailures++
+}
+
+// commandSent counts a command sent to the panel.
+func (m *metrics) commandSent(action string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.commands == nil {
+		m.commands = map[string]uint64{}
+	}
+
+	m.commands[action]++
+}
+
+// handleMetrics exposes the metrics in the Prometheus text format.
+func (b *bridge) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	b.metrics.lock.Lock()
+	fmt.Fprintf(w, "# HELP ad2mqtt_messages_total Messages parsed from the alarm.\n")
+	fmt.Fprintf(w, "# TYPE ad2mqtt_messages_total counter\n")
+	fmt.Fprintf(w, "ad2mqtt_messages_total %d\n", b.metrics.messages)
+
+	fmt.Fprintf(w, "# HELP ad2mqtt_parse_errors_total Messages from the alarm which couldn't be parsed.\n")
+	fmt.Fprintf(w, "# TYPE ad2mqtt_parse_errors_total counter\n")
+	fmt.Fprintf(w, "ad2mqtt_parse_errors_total %d\n", b.metrics.parseErrors)
+
+	fmt.Fprintf(w, "# HELP ad2mqtt_mqtt_publish_failures_total MQTT messages which failed to publish.\n")
+	fmt.Fprintf(w, "# TYPE ad2mqtt_mqtt_publish_failures_total counter\n")
+	fmt.Fprintf(w, "ad2mqtt_mqtt_publish_failures_total %d\n", b.metrics.publishFailures)
+
+	actions := make([]string, 0, len(b.metrics.commands))
+	for action := range b.metrics.commands {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	fmt.Fprintf(w, "# HELP ad2mqtt_commands_total Commands sent to the alarm.\n")
+	fmt.Fprintf(w, "# TYPE ad2mqtt_commands_total counter\n")
+	for _, action := range actions {
+		fmt.Fprintf(w, "ad2mqtt_commands_total{action=%q} %d\n", action, b.metrics.commands[action])
+	}
+	b.metrics.lock.Unlock()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP ad2mqtt_alarm_state Current alarm state of each partition.\n")
+	fmt.Fprintf(w, "# TYPE ad2mqtt_alarm_state gauge\n")
+	for _, p := range b.partitions {
+		for _, state := range alarmStates {
+			value := 0
+			if p.alarmState == state {
+				value = 1
+			}
+
+			fmt.Fprintf(w, "ad2mqtt_alarm_state{partition=\"%d\",state=%q} %d\n", p.id, state, value)
+		}
+	}
+
+	faulted := 0
+	for _, v := range b.zoneState {
+		if v {
+			faulted++
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP ad2mqtt_faulted_zones Zones currently faulted.\n")
+	fmt.Fprintf(w, "# TYPE ad2mqtt_faulted_zones gauge\n")
+	fmt.Fprintf(w, "ad2mqtt_faulted_zones %d\n", faulted)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// connectMQTT connects to the broker, retrying with an exponential backoff
+// as the broker may still be starting up. It gives up once the timeout is
+// reached, or retries forever if it's zero.
+func (b *bridge) connectMQTT(timeout time.Duration) error {
+	var waited time.Duration
+
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		token := b.mqttClient.Connect()
+		token.Wait()
+
+		err := token.Error()
+		if err == nil {
+			return nil
+		}
+
+		if timeout > 0 && waited+delay > timeout {
+			return fmt.Errorf("Failed to connect to the MQTT broker after %d attempts: %w", attempt, err)
+		}
+
+		logErrorf("[mqtt] Failed to connect to the broker, retrying in %s (attempt %d): %v", delay, attempt, err)
+		<-b.clock.After(delay)
+		waited += delay
+
+		delay *= 2
+		if delay > time.Minute {
+			delay = time.Minute
+		}
+	}
+}
+
+// setupMQTT marks the bridge as online, publishes all entities and
+// subscribes to the command topics.
+func (b *bridge) setupMQTT() error {
+	b.lock.Lock()
+	availability := b.availability()
+	b.lock.Unlock()
+
+	err := b.publishRetained(b.availabilityTopic(), availability)
+	if err != nil {
+		return err
+	}
+
+	err = b.republish()
+	if err != nil {
+		return err
+	}
+
+	queryHandler := func(client mqtt.Client, msg mqtt.Message) {
+		b.handleZoneQuery(string(msg.Payload()))
+	}
+
+	if token := b.mqttClient.Subscribe(b.zoneQueryTopic(), b.commandQoS, queryHandler); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	// Commands can't be sent to the panel in read-only mode.
+	if !b.panelEnabled || b.readOnly {
+		return nil
+	}
+
+	for _, p := range b.partitions {
+		p := p
+		handler := func(client mqtt.Client, msg mqtt.Message) {
+			b.handleCommand(p, msg.Payload())
+		}
+
+		if token := b.mqttClient.Subscribe(b.partitionTopic(p, "command"), b.commandQoS, handler); token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+	}
+
+	return nil
+}
+
+// handleConnect restores everything after the MQTT client reconnects, in case
+// the broker lost its retained messages or the last will got published.
+func (b *bridge) handleConnect(client mqtt.Client) {
+	b.lock.Lock()
+	ready := b.mqttReady
+	b.lock.Unlock()
+
+	// The initial connection is handled during startup.
+	if !ready {
+		return
+	}
+
+	logInfof("[mqtt] Reconnected to the broker")
+
+	err := b.setupMQTT()
+	if err != nil {
+		logErrorf("[mqtt] Failed to restore state after reconnecting: %v", err)
+	}
+}
+
+// mqttTLSConfig returns the TLS configuration for the MQTT connection or nil
+// if TLS isn't in use.
+func mqttTLSConfig() (*tls.Config, error) {
+	enabled, err := getEnvBool("MQTT_TLS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	host := lookupEnv("MQTT_HOST")
+	if !enabled && !strings.HasPrefix(host, "ssl://") && !strings.HasPrefix(host, "tls://") {
+		return nil, nil
+	}
+
+	insecure, err := getEnvBool("MQTT_TLS_INSECURE", false)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure,
+	}
+
+	// Load a custom CA.
+	caPath := lookupEnv("MQTT_CA_CERT")
+	if caPath != "" {
+		content, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load the MQTT CA certificate: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("Failed to parse the MQTT CA certificate %q", caPath)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	// Load a client certificate.
+	certPath := lookupEnv("MQTT_CLIENT_CERT")
+	keyPath := lookupEnv("MQTT_CLIENT_KEY")
+	if certPath != "" || keyPath != "" {
+		if certPath == "" || keyPath == "" {
+			return nil, fmt.Errorf("Both MQTT_CLIENT_CERT and MQTT_CLIENT_KEY must be set")
+		}
+
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load the MQTT client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+type errorToken struct {
+	mqtt.DummyToken
+	err error
+}
+
+func (t *errorToken) Error() error {
+	return t.err
+}
+
+// flakyClient fails to connect a number of times before succeeding.
+type flakyClient struct {
+	*dummyClient
+
+	failures int
+	attempts int
+}
+
+func (c *flakyClient) Connect() mqtt.Token {
+	c.attempts++
+	if c.attempts <= c.failures {
+		return &errorToken{err: errors.New("connection refused")}
+	}
+
+	return &mqtt.DummyToken{}
+}
+
+func TestConnectMQTT(t *testing.T) {
+	b, client := newTestBridge(nil)
+	b.clock = &fakeClock{now: time.Now()}
+
+	// The broker comes up after a few attempts.
+	flaky := &flakyClient{dummyClient: client, failures: 3}
+	b.mqttClient = flaky
+
+	err := b.connectMQTT(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if flaky.attempts != 4 {
+		t.Errorf("got %d attempts; wanted %d", flaky.attempts, 4)
+	}
+
+	// The broker never comes up.
+	flaky = &flakyClient{dummyClient: client, failures: 100}
+	b.mqttClient = flaky
+
+	err = b.connectMQTT(10 * time.Second)
+	if err == nil {
+		t.Fatal("expected the connection to time out")
+	}
+
+	// Retrying after 1s, 2s and 4s fits within 10s but 8s more doesn't.
+	if flaky.attempts != 4 {
+		t.Errorf("got %d attempts; wanted %d", flaky.attempts, 4)
+	}
+}
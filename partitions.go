@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+// partition is an alarm partition, exposed as its own alarm panel entity.
+type partition struct {
+	// id is the partition number, 0 for the default single partition setup.
+	id int
+
+	// mask selects the keypad messages for this partition, 0 matching all.
+	mask uint32
+
+	// keypadAddress is the keypad address to send keys from, 0 to use the
+	// address of the AlarmDecoder.
+	keypadAddress int
+
+	alarmState string
+
+	// faulted is set when the last keypad message reported the partition as
+	// disarmed but not ready to arm.
+	faulted bool
+
+	// lastCommand and lastCommandAt identify the last command received,
+	// used to ignore repeated commands.
+	lastCommand   string
+	lastCommandAt time.Time
+
+	// expected is the last command waiting for confirmation.
+	expected *pendingCommand
+
+	// attributes is the last JSON encoded panelAttributes.
+	attributes string
+}
+
+// panelAttributes are the extra attributes of an alarm panel entity, taken
+// from the last keypad message.
+type panelAttributes struct {
+	ACPower         bool   `json:"ac_power"`
+	BatteryLow      bool   `json:"battery_low"`
+	Chime           bool   `json:"chime"`
+	Beeps           int    `json:"beeps"`
+	ProgrammingMode bool   `json:"programming_mode"`
+	Fire            bool   `json:"fire"`
+	Bypass          bool   `json:"bypass"`
+	LastZone        string `json:"last_zone"`
+	Keypad          string `json:"keypad"`
+}
+
+// matches returns whether a keypad message is intended for the partition.
+func (p *partition) matches(msg alarmdecoder.Message) bool {
+	return p.mask == 0 || msg.KeypadAddressMask&p.mask != 0
+}
+
+// keypad returns the keypad sending the commands of the partition, the
+// AlarmDecoder's own unless the partition has a keypad address.
+func (p *partition) keypad(ad *alarmdecoder.AlarmDecoder) alarmdecoder.Commander {
+	if p.keypadAddress == 0 {
+		return ad
+	}
+
+	return ad.Keypad(p.keypadAddress)
+}
+
+// parsePartitions parses a list of partitions, each formatted as
+// <number>:<address mask>[:<keypad address>] with the mask in hex. An empty
+// list results in a single partition handling all messages.
+func parsePartitions(entries []string) ([]*partition, error) {
+	if len(entries) == 0 {
+		return []*partition{{}}, nil
+	}
+
+	partitions := make([]*partition, 0, len(entries))
+	seen := map[int]bool{}
+	for _, entry := range entries {
+		fields := strings.Split(entry, ":")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("Invalid partition %q", entry)
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("Invalid partition number in %q", entry)
+		}
+
+		if seen[id] {
+			return nil, fmt.Errorf("Duplicate partition %d", id)
+		}
+
+		seen[id] = true
+
+		mask, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 32)
+		if err != nil || mask == 0 {
+			return nil, fmt.Errorf("Invalid address mask in partition %q", entry)
+		}
+
+		p := &partition{id: id, mask: uint32(mask)}
+		if len(fields) == 3 {
+			p.keypadAddress, err = strconv.Atoi(fields[2])
+			if err != nil || p.keypadAddress <= 0 || p.keypadAddress > 99 {
+				return nil, fmt.Errorf("Invalid keypad address in partition %q", entry)
+			}
+		}
+
+		partitions = append(partitions, p)
+	}
+
+	return partitions, nil
+}
+
+// partitionTopic returns the topic for the given suffix of a partition's alarm
+// panel entity. The default partition uses the panel topics.
+func (b *bridge) partitionTopic(p *partition, suffix string) string {
+	if p.id == 0 {
+		return b.panelTopic(suffix)
+	}
+
+	return b.panelTopic(fmt.Sprintf("partition%d/%s", p.id, suffix))
+}
+
+// partitionUniqueID returns the Home Assistant unique ID of a partition.
+func (b *bridge) partitionUniqueID(p *partition) string {
+	if p.id == 0 {
+		return b.deviceID
+	}
+
+	return fmt.Sprintf("%s_partition%d", b.deviceID, p.id)
+}
+
+// setAttributes updates the attributes of a partition from a keypad message,
+// publishing them if they changed. The caller must hold the lock.
+func (b *bridge) setAttributes(p *partition, msg alarmdecoder.Message) error {
+	data, err := json.Marshal(panelAttributes{
+		ACPower:         msg.ACPower,
+		BatteryLow:      msg.BatteryLow,
+		Chime:           msg.ChimeEnabled,
+		Beeps:           msg.Beeps,
+		ProgrammingMode: msg.ProgrammingMode,
+		Fire:            msg.Fire,
+		Bypass:          msg.ZoneBypassed,
+		LastZone:        msg.Zone,
+		Keypad:          msg.KeypadMessage,
+	})
+	if err != nil {
+		return err
+	}
+
+	if string(data) == p.attributes {
+		return nil
+	}
+
+	p.attributes = string(data)
+
+	return b.publishThrottled(b.partitionTopic(p, "attributes"), p.attributes)
+}
+
+// setAlarmState updates the state of a partition, publishing it if it
+// changed. The caller must hold the lock.
+func (b *bridge) setAlarmState(p *partition, state string) error {
+	if state == p.alarmState {
+		return nil
+	}
+
+	p.alarmState = state
+	b.saveState()
+
+	err := b.publish(b.partitionTopic(p, "state"), state)
+	if err != nil {
+		return err
+	}
+
+	if p.id == 0 {
+		logInfof("[alarm] Set state to %s", state)
+	} else {
+		logInfof("[alarm] Set partition %d state to %s", p.id, state)
+	}
+
+	return nil
+}
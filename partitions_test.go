@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+func TestParsePartitions(t *testing.T) {
+	partitions, err := parsePartitions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(partitions) != 1 || partitions[0].id != 0 || partitions[0].mask != 0 {
+		t.Errorf("expected a single default partition, got %+v", partitions)
+	}
+
+	partitions, err = parsePartitions([]string{"1:01000000", "2:0x02000000:18"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(partitions) != 2 || partitions[1].id != 2 || partitions[1].mask != 0x02000000 || partitions[1].keypadAddress != 18 {
+		t.Errorf("unexpected partitions %+v", partitions)
+	}
+
+	for _, entries := range [][]string{{"1"}, {"0:01"}, {"1:zz"}, {"1:00"}, {"1:01", "1:02"}, {"1:01:100"}} {
+		_, err := parsePartitions(entries)
+		if err == nil {
+			t.Errorf("parsePartitions(%q) should have failed", entries)
+		}
+	}
+}
+
+func TestPartitionState(t *testing.T) {
+	b, client := newTestBridge(nil)
+	b.partitions = []*partition{{id: 1, mask: 0x01000000}, {id: 2, mask: 0x02000000}}
+
+	err := b.handleMessage(alarmdecoder.Message{ArmedAway: true, KeypadAddressMask: 0x02000000, UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.handleMessage(alarmdecoder.Message{Ready: true, KeypadAddressMask: 0x01000000, UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state1, _ := client.get("homeassistant/alarm_control_panel/ad2mqtt/partition1/state")
+	state2, _ := client.get("homeassistant/alarm_control_panel/ad2mqtt/partition2/state")
+	if state1 != "disarmed" || state2 != "armed_away" {
+		t.Errorf("got partition states %q and %q; wanted %q and %q", state1, state2, "disarmed", "armed_away")
+	}
+}
+
+func TestPartitionCommands(t *testing.T) {
+	b, _ := newTestBridge(nil)
+	b.codeLength = 4
+	b.partitions = []*partition{{id: 1, mask: 0x01000000}, {id: 2, mask: 0x02000000, keypadAddress: 18}}
+
+	keys := &keyRecorder{}
+	b.ad = alarmdecoder.New(keys)
+	b.ad.SetKeyDelay(0)
+
+	// Commands for a partition with a keypad address are sent from it in a
+	// single write.
+	b.handleCommand(b.partitions[1], []byte(`{"action": "DISARM", "code": "1234"}`))
+	if keys.String() != "K1812341" || keys.writes != 1 {
+		t.Errorf("got keys %q in %d writes; wanted %q in 1", keys.String(), keys.writes, "K1812341")
+	}
+
+	keys.Reset()
+	keys.writes = 0
+	b.handleCommand(b.partitions[0], []byte(`{"action": "DISARM", "code": "1234"}`))
+	if keys.String() != "12341" || keys.writes != 5 {
+		t.Errorf("got keys %q in %d writes; wanted %q in 5", keys.String(), keys.writes, "12341")
+	}
+}
+
+func TestPartitionAttributes(t *testing.T) {
+	b, client := newTestBridge(nil)
+
+	err := b.handleMessage(alarmdecoder.Message{Ready: true, ACPower: true, Beeps: 2, Zone: "008", KeypadMessage: "READY", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, count := client.get("homeassistant/alarm_control_panel/ad2mqtt/attributes")
+	want := `{"ac_power":true,"battery_low":false,"chime":false,"beeps":2,"programming_mode":false,"fire":false,"bypass":false,"last_zone":"008","keypad":"READY"}`
+	if value != want {
+		t.Errorf("got attributes %s; wanted %s", value, want)
+	}
+
+	// Unchanged attributes aren't published again.
+	err = b.handleMessage(alarmdecoder.Message{Ready: true, ACPower: true, Beeps: 2, Zone: "008", KeypadMessage: "READY", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, newCount := client.get("homeassistant/alarm_control_panel/ad2mqtt/attributes")
+	if newCount != count {
+		t.Errorf("got %d publishes for unchanged attributes; wanted %d", newCount, count)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+// dryRunPort logs what would be written to the AlarmDecoder instead of
+// sending it.
+type dryRunPort struct {
+	io.ReadWriteCloser
+}
+
+// Write logs the data without sending it.
+func (p dryRunPort) Write(b []byte) (int, error) {
+	logInfof("[alarm] Dry run, not sending %q", string(b))
+	return len(b), nil
+}
+
+// newDecoder returns the AlarmDecoder reading from and writing to a port,
+// configured from the settings.
+func (b *bridge) newDecoder(port io.ReadWriter) *alarmdecoder.AlarmDecoder {
+	ad := alarmdecoder.New(port)
+	ad.SetKeyDelay(b.keyDelay)
+	ad.SetClock(b.clock)
+	ad.SetReadOnly(b.readOnly)
+
+	// The configured mode takes precedence over the keypad messages.
+	if b.modeForced {
+		ad.ForceMode(b.mode)
+	}
+
+	return ad
+}
+
+// openPort opens the connection to the AlarmDecoder, recording everything
+// read from it if a capture file is set. Writes only get logged in dry run
+// mode.
+func openPort(dryRun bool) (io.ReadWriteCloser, error) {
+	port, err := openDevice()
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		port = dryRunPort{port}
+	}
+
+	capture := lookupEnv("AD_CAPTURE")
+	if capture == "" {
+		return port, nil
+	}
+
+	captured, err := openCapture(port, capture)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+
+	return captured, nil
+}
+
+// openDevice opens the AlarmDecoder, either directly over serial or over TCP
+// when connecting to ser2sock. A replay file can be used in place of a real
+// device.
+func openDevice() (io.ReadWriteCloser, error) {
+	// Setup replay.
+	replay := lookupEnv("AD_REPLAY")
+	if replay != "" {
+		realtime, err := getEnvBool("AD_REPLAY_REALTIME", false)
+		if err != nil {
+			return nil, err
+		}
+
+		return openReplay(replay, realtime)
+	}
+
+	// Setup TCP connection.
+	address := lookupEnv("AD_TCP")
+	if address == "" && !strings.HasPrefix(lookupEnv("AD_PATH"), "/") {
+		_, _, err := net.SplitHostPort(lookupEnv("AD_PATH"))
+		if err == nil {
+			address = lookupEnv("AD_PATH")
+		}
+	}
+
+	if address != "" {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to connect to %q: %w", address, err)
+		}
+
+		return conn, nil
+	}
+
+	// Setup serial connection.
+	options, err := serialOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := serial.Open(options)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open serial port: %w", err)
+	}
+
+	return port, nil
+}
+
+// serialOptions returns the serial port settings, defaulting to 115200 8N1.
+func serialOptions() (serial.OpenOptions, error) {
+	baudRate, err := getEnvInt("AD_BAUD_RATE", 115200)
+	if err != nil {
+		return serial.OpenOptions{}, err
+	}
+
+	if baudRate <= 0 {
+		return serial.OpenOptions{}, fmt.Errorf("Invalid value for AD_BAUD_RATE: %d", baudRate)
+	}
+
+	dataBits, err := getEnvInt("AD_DATA_BITS", 8)
+	if err != nil {
+		return serial.OpenOptions{}, err
+	}
+
+	if dataBits < 5 || dataBits > 8 {
+		return serial.OpenOptions{}, fmt.Errorf("Invalid value for AD_DATA_BITS: %d (must be between 5 and 8)", dataBits)
+	}
+
+	stopBits, err := getEnvInt("AD_STOP_BITS", 1)
+	if err != nil {
+		return serial.OpenOptions{}, err
+	}
+
+	if stopBits != 1 && stopBits != 2 {
+		return serial.OpenOptions{}, fmt.Errorf("Invalid value for AD_STOP_BITS: %d (must be 1 or 2)", stopBits)
+	}
+
+	parityModes := map[string]serial.ParityMode{
+		"none": serial.PARITY_NONE,
+		"odd":  serial.PARITY_ODD,
+		"even": serial.PARITY_EVEN,
+	}
+
+	parity := strings.ToLower(getEnv("AD_PARITY", "none"))
+	parityMode, ok := parityModes[parity]
+	if !ok {
+		return serial.OpenOptions{}, fmt.Errorf("Invalid value for AD_PARITY: %q (must be none, odd or even)", parity)
+	}
+
+	// Reads return once AD_MIN_READ_SIZE bytes were received, or once no
+	// byte was received for AD_INTER_CHARACTER_TIMEOUT after the first one.
+	// A minimum read size of 1 delivers every byte as soon as it arrives at
+	// the cost of more system calls, a larger one reduces the overhead but
+	// can hold back the end of a message unless the timeout is set.
+	minReadSize, err := getEnvInt("AD_MIN_READ_SIZE", 1)
+	if err != nil {
+		return serial.OpenOptions{}, err
+	}
+
+	// A read returning nothing would look like the connection got closed.
+	if minReadSize < 1 || minReadSize > 255 {
+		return serial.OpenOptions{}, fmt.Errorf("Invalid value for AD_MIN_READ_SIZE: %d (must be between 1 and 255)", minReadSize)
+	}
+
+	// The timeout has a 100ms resolution and is limited to 25.5s by termios.
+	interCharacterTimeout, err := getEnvDuration("AD_INTER_CHARACTER_TIMEOUT", 0)
+	if err != nil {
+		return serial.OpenOptions{}, err
+	}
+
+	if interCharacterTimeout < 0 || interCharacterTimeout > 25500*time.Millisecond || interCharacterTimeout%(100*time.Millisecond) != 0 {
+		return serial.OpenOptions{}, fmt.Errorf("Invalid value for AD_INTER_CHARACTER_TIMEOUT: %s (must be a multiple of 100ms up to 25.5s)", interCharacterTimeout)
+	}
+
+	if minReadSize > 1 && interCharacterTimeout == 0 {
+		logWarnf("[alarm] AD_MIN_READ_SIZE is set without AD_INTER_CHARACTER_TIMEOUT, messages may be delayed")
+	}
+
+	return serial.OpenOptions{
+		PortName:              lookupEnv("AD_PATH"),
+		BaudRate:              uint(baudRate),
+		DataBits:              uint(dataBits),
+		StopBits:              uint(stopBits),
+		ParityMode:            parityMode,
+		MinimumReadSize:       uint(minReadSize),
+		InterCharacterTimeout: uint(interCharacterTimeout / time.Millisecond),
+	}, nil
+}
+
+// isConnectionError returns whether the error indicates that the connection
+// to the AlarmDecoder was lost, as opposed to a message that couldn't be parsed.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	var pathErr *os.PathError
+
+	return errors.Is(err, alarmdecoder.ErrClosed) || errors.Is(err, io.EOF) || errors.As(err, &netErr) || errors.As(err, &pathErr)
+}
+
+// reconnect closes the current connection to the AlarmDecoder and keeps
+// trying to re-open it with exponential backoff until it succeeds or the
+// context gets cancelled.
+func (b *bridge) reconnect(ctx context.Context) error {
+	b.port.Close()
+
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		logInfof("[alarm] Reconnecting in %s (attempt %d)", delay, attempt)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-b.clock.After(delay):
+		}
+
+		port, err := openPort(b.dryRun)
+		if err != nil {
+			logErrorf("[alarm] Failed to reconnect: %v", err)
+
+			delay *= 2
+			if delay > time.Minute {
+				delay = time.Minute
+			}
+
+			continue
+		}
+
+		b.adLock.Lock()
+		b.port = port
+		b.ad = b.newDecoder(port)
+		b.adLock.Unlock()
+
+		logInfof("[alarm] Reconnected to alarm")
+		return nil
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+func TestSerialOptions(t *testing.T) {
+	options, err := serialOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.BaudRate != 115200 || options.DataBits != 8 || options.StopBits != 1 || options.ParityMode != serial.PARITY_NONE || options.MinimumReadSize != 1 || options.InterCharacterTimeout != 0 {
+		t.Errorf("unexpected default options %+v", options)
+	}
+
+	t.Setenv("AD_BAUD_RATE", "9600")
+	t.Setenv("AD_DATA_BITS", "7")
+	t.Setenv("AD_STOP_BITS", "2")
+	t.Setenv("AD_PARITY", "Even")
+	t.Setenv("AD_MIN_READ_SIZE", "16")
+	t.Setenv("AD_INTER_CHARACTER_TIMEOUT", "200ms")
+
+	options, err = serialOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.BaudRate != 9600 || options.DataBits != 7 || options.StopBits != 2 || options.ParityMode != serial.PARITY_EVEN {
+		t.Errorf("unexpected options %+v", options)
+	}
+
+	if options.MinimumReadSize != 16 || options.InterCharacterTimeout != 200 {
+		t.Errorf("unexpected read options %+v", options)
+	}
+
+	for name, value := range map[string]string{
+		"AD_BAUD_RATE": "fast",
+		"AD_DATA_BITS": "9",
+		"AD_STOP_BITS": "3",
+		"AD_PARITY":    "mark",
+
+		"AD_MIN_READ_SIZE":           "0",
+		"AD_INTER_CHARACTER_TIMEOUT": "150ms",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+
+			_, err := serialOptions()
+			if err == nil {
+				t.Errorf("serialOptions with %s=%q should have failed", name, value)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay")
+	err := os.WriteFile(path, []byte("[10000001100000003A--],000,[f70000000000000000000000000000],\"READY\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("AD_REPLAY", path)
+
+	port, err := openPort(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	if _, ok := port.(dryRunPort); !ok {
+		t.Fatalf("expected a dry run port, got %T", port)
+	}
+
+	// Decoding still works.
+	ad := alarmdecoder.New(port)
+	ad.SetKeyDelay(0)
+
+	msg, err := ad.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !msg.Ready {
+		t.Errorf("expected the replayed message to be read")
+	}
+
+	err = ad.SendKeys("1234")
+	if err != nil {
+		t.Errorf("dry run write failed: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+// faultRefresh collects the zones reported by the panel after asking it to
+// list the current faults.
+type faultRefresh struct {
+	seen  map[string]bool
+	timer alarmdecoder.Timer
+}
+
+// startFaultRefresh collects the faulted zones reported over the refresh
+// window, then clears any other zone still marked as faulted.
+func (b *bridge) startFaultRefresh() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.refresh != nil {
+		b.refresh.timer.Stop()
+	}
+
+	refresh := &faultRefresh{seen: map[string]bool{}}
+	refresh.timer = b.clock.AfterFunc(b.refreshWindow, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		if b.refresh != refresh {
+			return
+		}
+
+		b.refresh = nil
+
+		err := b.clearZones(func(k string) bool { return refresh.seen[k] })
+		if err != nil {
+			logErrorf("[mqtt] Failed to refresh the faulted zones: %v", err)
+			return
+		}
+
+		logInfof("[alarm] Refreshed the faulted zones, %d currently faulted", len(refresh.seen))
+	})
+
+	b.refresh = refresh
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// captureTimeFormat is the timestamp format prefixed to the lines of a capture.
+const captureTimeFormat = time.RFC3339Nano
+
+// replayPort replays AlarmDecoder messages from a file instead of talking to
+// a real device. Keys sent to it are only logged.
+type replayPort struct {
+	source io.ReadCloser
+	reader *io.PipeReader
+	writer *io.PipeWriter
+}
+
+// openReplay opens a replay of the messages in the file, or stdin for "-".
+// Lines may be prefixed by the timestamp at which they were captured, in
+// which case the original timing is honored if realtime is set.
+func openReplay(path string, realtime bool) (io.ReadWriteCloser, error) {
+	var source io.ReadCloser
+	if path == "-" {
+		source = io.NopCloser(os.Stdin)
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open the replay file: %w", err)
+		}
+
+		source = f
+	}
+
+	reader, writer := io.Pipe()
+	p := &replayPort{source: source, reader: reader, writer: writer}
+	go p.replay(realtime)
+
+	return p, nil
+}
+
+// replay copies the messages from the source into the pipe.
+func (p *replayPort) replay(realtime bool) {
+	var last time.Time
+
+	scanner := bufio.NewScanner(p.source)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) == 2 {
+			ts, err := time.Parse(captureTimeFormat, fields[0])
+			if err == nil {
+				line = fields[1]
+
+				if realtime && !last.IsZero() && ts.After(last) {
+					time.Sleep(ts.Sub(last))
+				}
+
+				last = ts
+			}
+		}
+
+		_, err := p.writer.Write([]byte(line + "\n"))
+		if err != nil {
+			// The port was closed.
+			return
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		logErrorf("[alarm] Failed to read the replay file: %v", err)
+	}
+
+	// Keep the port open so the bridge stays up with the replayed state.
+	logInfof("[alarm] Replay finished")
+}
+
+// Read reads the replayed messages.
+func (p *replayPort) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+// Write logs the keys which would have been sent to the panel.
+func (p *replayPort) Write(b []byte) (int, error) {
+	logInfof("[alarm] Replay mode, not sending %q", string(b))
+	return len(b), nil
+}
+
+// Close stops the replay.
+func (p *replayPort) Close() error {
+	p.writer.Close()
+	p.reader.Close()
+	return p.source.Close()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+func TestReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.txt")
+	content := "2021-01-01T00:00:00Z [10000601100000003A--],045,[f71f00000045001c28020000000000],\"READY\"\n" +
+		"[00000000011000003A--],,,\"test\"\n"
+
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := openReplay(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	ad := alarmdecoder.New(port)
+	for _, want := range []string{"READY", "test"} {
+		msg, err := ad.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.KeypadMessage != want {
+			t.Errorf("got keypad message %q; wanted %q", msg.KeypadMessage, want)
+		}
+	}
+
+	// Keys don't go anywhere.
+	err = ad.SendKeys("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+// binarySensor is a binary sensor derived from the panel status.
+type binarySensor struct {
+	id          string
+	name        string
+	deviceClass string
+	state       func(msg alarmdecoder.Message) bool
+
+	// diagnostic marks sensors only useful to troubleshoot the panel.
+	diagnostic bool
+}
+
+var binarySensors = []binarySensor{
+	{"ac_power", "AC power", "power", func(msg alarmdecoder.Message) bool { return msg.ACPower }, false},
+	{"battery", "Battery", "battery", func(msg alarmdecoder.Message) bool { return msg.BatteryLow }, false},
+	{"chime", "Chime", "", func(msg alarmdecoder.Message) bool { return msg.ChimeEnabled }, false},
+	{"bypass", "Zone bypassed", "", func(msg alarmdecoder.Message) bool { return msg.ZoneBypassed }, false},
+	{"programming", "Programming mode", "problem", func(msg alarmdecoder.Message) bool { return msg.ProgrammingMode }, true},
+}
+
+// troubleSensor reports troubles (tampers, supervision failures, ...) shown on
+// the keypad, tracked across messages by the bridge.
+var troubleSensor = binarySensor{"trouble", "Trouble", "problem", nil, false}
+
+// fireSensor reports a fire alarm, latched by the bridge until the panel gets
+// disarmed as the fire bit tends to flicker.
+var fireSensor = binarySensor{"fire", "Fire", "smoke", nil, false}
+
+// latchedSensors are the binary sensors whose state is tracked by the bridge
+// rather than derived from a single message.
+var latchedSensors = []binarySensor{troubleSensor, fireSensor}
+
+// sensor is a sensor derived from the panel status.
+type sensor struct {
+	id    string
+	name  string
+	icon  string
+	unit  string
+	value func(msg alarmdecoder.Message) string
+
+	// diagnostic marks sensors only useful to troubleshoot the panel.
+	diagnostic bool
+}
+
+var sensors = []sensor{
+	{"keypad", "Keypad", "mdi:dialpad", "", func(msg alarmdecoder.Message) string { return msg.KeypadMessage }, false},
+	{"beeps", "Beeps", "mdi:volume-high", "", func(msg alarmdecoder.Message) string { return strconv.Itoa(msg.Beeps) }, true},
+}
+
+// lastAlarmZoneSensor reports the zone which caused the last alarm, tracked
+// by the bridge.
+var lastAlarmZoneSensor = sensor{"last_alarm_zone", "Last alarm zone", "mdi:alarm-light", "", nil, false}
+
+// flappingZonesSensor reports the zones whose state is held back as they
+// keep changing, usually pointing at a faulty sensor.
+var flappingZonesSensor = sensor{"flapping_zones", "Flapping zones", "mdi:alert", "", nil, true}
+
+// trackedSensors are the sensors whose value is tracked by the bridge rather
+// than derived from a single message.
+var trackedSensors = []sensor{lastAlarmZoneSensor, flappingZonesSensor}
+
+// sensorTopic returns the topic for the given suffix of a panel sensor entity.
+func (b *bridge) sensorTopic(component string, id string, suffix string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%s", b.discoveryPrefix, component, b.deviceID, id, suffix)
+}
+
+// publishSensorConfig publishes the Home Assistant discovery configuration
+// for the panel sensors.
+func (b *bridge) publishSensorConfig() error {
+	for _, sensor := range append(binarySensors, latchedSensors...) {
+		err := b.publishJSON(b.sensorTopic("binary_sensor", sensor.id, "config"), b.panelBinarySensorConfig(sensor))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, sensor := range append(sensors, trackedSensors...) {
+		err := b.publishJSON(b.sensorTopic("sensor", sensor.id, "config"), b.panelSensorConfig(sensor))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publishSensorState publishes the last known state of the panel sensors.
+func (b *bridge) publishSensorState() error {
+	for topic, value := range b.sensorState {
+		err := b.publish(topic, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setSensorState updates the state of a panel sensor, publishing it if it changed.
+func (b *bridge) setSensorState(component string, id string, value string) error {
+	topic := b.sensorTopic(component, id, "state")
+	if b.sensorState[topic] == value {
+		return nil
+	}
+
+	b.sensorState[topic] = value
+	logInfof("[alarm] Set %s to %s", id, value)
+
+	err := b.publishThrottled(topic, value)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// updateFire latches the fire sensor when the fire bit is set, clearing it
+// once the panel goes from armed or in alarm to disarmed.
+func (b *bridge) updateFire(prev alarmdecoder.Message, msg alarmdecoder.Message) error {
+	active := func(m alarmdecoder.Message) bool {
+		return m.ArmedAway || m.ArmedHome || m.AlarmSounding || m.AlarmHasOccured
+	}
+
+	if msg.Fire && !b.fireLatched {
+		logWarnf("[alarm] Fire alarm reported by the panel")
+		b.fireLatched = true
+	} else if !msg.Fire && active(prev) && !active(msg) {
+		b.fireLatched = false
+	}
+
+	return b.updateFireSensor()
+}
+
+// updateFireSensor publishes the latched fire state. The caller must hold
+// the lock.
+func (b *bridge) updateFireSensor() error {
+	value := "off"
+	if b.fireLatched {
+		value = "on"
+	}
+
+	return b.setSensorState("binary_sensor", fireSensor.id, value)
+}
+
+// updateLastAlarmZone records the zone responsible for an alarm when a
+// partition gets triggered, clearing it when the partition gets armed again.
+// The caller must hold the lock.
+func (b *bridge) updateLastAlarmZone(msg alarmdecoder.Message, oldState string, newState string) error {
+	if oldState == newState {
+		return nil
+	}
+
+	if newState == "arming" || strings.HasPrefix(newState, "armed_") {
+		return b.setSensorState("sensor", lastAlarmZoneSensor.id, "")
+	} else if newState != "triggered" {
+		return nil
+	}
+
+	// Alarm messages usually report the zone, otherwise go with the last
+	// faulted zone.
+	k := msg.Zone
+	if _, _, ok := b.lookupZone(k); !ok {
+		k = b.lastFaultedZone
+	}
+
+	if k == "" {
+		return nil
+	}
+
+	name := fmt.Sprintf("Zone %s", k)
+	_, zone, ok := b.lookupZone(k)
+	if ok && zone.FriendlyName != "" {
+		name = fmt.Sprintf("%s (zone %s)", zone.FriendlyName, k)
+	} else if ok && zone.Name != "" {
+		name = fmt.Sprintf("%s (zone %s)", zone.Name, k)
+	}
+
+	logWarnf("[alarm] Alarm triggered by %s", name)
+
+	return b.setSensorState("sensor", lastAlarmZoneSensor.id, name)
+}
+
+// updateSensors updates all panel sensors from a keypad message.
+func (b *bridge) updateSensors(msg alarmdecoder.Message) error {
+	for _, sensor := range binarySensors {
+		value := "off"
+		if sensor.state(msg) {
+			value = "on"
+		}
+
+		err := b.setSensorState("binary_sensor", sensor.id, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, sensor := range sensors {
+		err := b.setSensorState("sensor", sensor.id, sensor.value(msg))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
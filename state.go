@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// stateSaveDelay is how long state changes get collected before writing the
+// state file.
+const stateSaveDelay = time.Second
+
+// savedState is the state persisted across restarts.
+type savedState struct {
+	Partitions map[int]string  `json:"partitions"`
+	Zones      map[string]bool `json:"zones"`
+}
+
+// loadState restores the alarm and zone state from the state file. A missing
+// or invalid state file is ignored.
+func (b *bridge) loadState() {
+	if b.stateFile == "" {
+		return
+	}
+
+	data, err := os.ReadFile(b.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logWarnf("[alarm] Ignoring state file %q: %v", b.stateFile, err)
+		}
+
+		return
+	}
+
+	state := savedState{}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		logWarnf("[alarm] Ignoring state file %q: %v", b.stateFile, err)
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, p := range b.partitions {
+		p.alarmState = state.Partitions[p.id]
+	}
+
+	for k, v := range state.Zones {
+		if _, _, ok := b.lookupZone(k); ok {
+			b.zoneState[k] = v
+		}
+	}
+}
+
+// saveState schedules writing the alarm and zone state to the state file,
+// coalescing the changes made within stateSaveDelay into a single write done
+// outside of the lock. The caller must hold the lock.
+func (b *bridge) saveState() {
+	if b.stateFile == "" || b.stateTimer != nil {
+		return
+	}
+
+	b.stateTimer = b.clock.AfterFunc(stateSaveDelay, b.writeState)
+}
+
+// flushState writes the pending state changes, if any.
+func (b *bridge) flushState() {
+	b.lock.Lock()
+	timer := b.stateTimer
+	b.lock.Unlock()
+
+	if timer != nil {
+		timer.Stop()
+		b.writeState()
+	}
+}
+
+// writeState writes the alarm and zone state to the state file.
+func (b *bridge) writeState() {
+	// Serialize the writes so an older state can't replace a newer one.
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+
+	b.lock.Lock()
+	b.stateTimer = nil
+
+	state := savedState{Partitions: map[int]string{}, Zones: b.zoneState}
+	for _, p := range b.partitions {
+		state.Partitions[p.id] = p.alarmState
+	}
+
+	data, err := json.Marshal(state)
+	b.lock.Unlock()
+
+	if err != nil {
+		logErrorf("[alarm] Failed to encode the state: %v", err)
+		return
+	}
+
+	// Write to a temporary file first so a crash can't leave a truncated file.
+	err = os.WriteFile(b.stateFile+".tmp", data, 0600)
+	if err != nil {
+		logErrorf("[alarm] Failed to write the state file: %v", err)
+		return
+	}
+
+	err = os.Rename(b.stateFile+".tmp", b.stateFile)
+	if err != nil {
+		logErrorf("[alarm] Failed to write the state file: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+func TestState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	zones := map[string]zone{"005": {Name: "door"}}
+
+	b, _ := newTestBridge(zones)
+	b.stateFile = path
+
+	clock := &fakeClock{now: time.Now()}
+	b.clock = clock
+
+	err := b.handleMessage(alarmdecoder.Message{Zone: "005", UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The changes get written together once the delay expired.
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Fatalf("state file was written right away: %v", err)
+	}
+
+	clock.Advance(stateSaveDelay)
+
+	_, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The state is restored by a new bridge.
+	b, _ = newTestBridge(zones)
+	b.stateFile = path
+	b.loadState()
+
+	if b.partitions[0].alarmState != "disarmed" || !b.zoneState["005"] {
+		t.Fatalf("got state %q with zone %v; wanted %q with zone on", b.partitions[0].alarmState, b.zoneState["005"], "disarmed")
+	}
+
+	// A corrupt state file is ignored.
+	err = os.WriteFile(path, []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ = newTestBridge(zones)
+	b.stateFile = path
+	b.loadState()
+
+	if b.partitions[0].alarmState != "" || b.zoneState["005"] {
+		t.Fatalf("got state %q with zone %v from a corrupt file; wanted nothing", b.partitions[0].alarmState, b.zoneState["005"])
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"time"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+// throttle tracks what was last published on each state topic so identical
+// values aren't republished and rapidly changing values get coalesced.
+type throttle struct {
+	// interval is the minimum time between two publishes on a topic.
+	interval time.Duration
+
+	published   map[string]string
+	publishedAt map[string]time.Time
+	pending     map[string]alarmdecoder.Timer
+}
+
+func newThrottle(interval time.Duration) *throttle {
+	return &throttle{
+		interval:    interval,
+		published:   map[string]string{},
+		publishedAt: map[string]time.Time{},
+		pending:     map[string]alarmdecoder.Timer{},
+	}
+}
+
+// publishThrottled publishes a state value unless it's identical to the last
+// one. If the topic was published too recently, the latest value is published
+// once the interval expires instead. The caller must hold the lock.
+func (b *bridge) publishThrottled(topic string, value string) error {
+	t := b.throttle
+
+	// Drop any older value waiting to be published.
+	timer, ok := t.pending[topic]
+	if ok {
+		timer.Stop()
+		delete(t.pending, topic)
+	}
+
+	if t.published[topic] == value && !t.publishedAt[topic].IsZero() {
+		return nil
+	}
+
+	wait := t.interval - b.clock.Now().Sub(t.publishedAt[topic])
+	if wait > 0 {
+		var timer alarmdecoder.Timer
+		timer = b.clock.AfterFunc(wait, func() {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+
+			// A newer value got handled while the timer was firing.
+			if t.pending[topic] != timer {
+				return
+			}
+
+			delete(t.pending, topic)
+
+			err := b.publishThrottled(topic, value)
+			if err != nil {
+				logErrorf("[mqtt] Failed to publish to %q: %v", topic, err)
+			}
+		})
+
+		t.pending[topic] = timer
+
+		return nil
+	}
+
+	err := b.publish(topic, value)
+	if err != nil {
+		return err
+	}
+
+	t.published[topic] = value
+	t.publishedAt[topic] = b.clock.Now()
+
+	return nil
+}
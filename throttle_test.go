@@ -0,0 +1,83 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestPublishThrottled(t *testing.T) {
+	b, client := newTestBridge(nil)
+	b.throttle = newThrottle(50 * time.Millisecond)
+
+	clock := &fakeClock{now: time.Now()}
+	b.clock = clock
+
+	publish := func(value string) {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		err := b.publishThrottled("test/state", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first value goes out immediately, identical ones are dropped.
+	publish("a")
+	publish("a")
+	value, count := client.get("test/state")
+	if value != "a" || count != 1 {
+		t.Fatalf("got %q after %d publishes; wanted %q after 1", value, count, "a")
+	}
+
+	// Rapid changes get coalesced into the latest value.
+	publish("b")
+	publish("c")
+	value, count = client.get("test/state")
+	if value != "a" || count != 1 {
+		t.Fatalf("got %q after %d publishes; wanted %q after 1", value, count, "a")
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	value, count = client.get("test/state")
+	if value != "c" || count != 2 {
+		t.Fatalf("got %q after %d publishes; wanted %q after 2", value, count, "c")
+	}
+
+	// A change reverted within the interval isn't published at all.
+	publish("d")
+	publish("e")
+	publish("d")
+	clock.Advance(100 * time.Millisecond)
+	value, count = client.get("test/state")
+	if value != "d" || count != 3 {
+		t.Fatalf("got %q after %d publishes; wanted %q after 3", value, count, "d")
+	}
+
+	// A value handled while the timer of the previous one is firing wins.
+	publish("f")
+	publish("g")
+	b.lock.Lock()
+	done := make(chan struct{})
+	go func() {
+		clock.Advance(100 * time.Millisecond)
+		close(done)
+	}()
+
+	for clock.Pending() > 0 {
+		runtime.Gosched()
+	}
+
+	err := b.publishThrottled("test/state", "f")
+	b.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-done
+	value, count = client.get("test/state")
+	if value != "f" || count != 4 {
+		t.Fatalf("got %q after %d publishes; wanted %q after 4", value, count, "f")
+	}
+}
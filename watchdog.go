@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+)
+
+// startWatchdog marks the panel as unavailable if no message is received
+// from it within the timeout. A zero timeout disables the watchdog.
+func (b *bridge) startWatchdog(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	b.watchdogTimeout = timeout
+	b.watchdog = b.clock.AfterFunc(timeout, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		logWarnf("[alarm] No message received from the alarm in %s, marking it unavailable", timeout)
+		b.commLost = true
+
+		err := b.publishRetained(b.availabilityTopic(), b.availability())
+		if err != nil {
+			logErrorf("[mqtt] Failed to publish availability: %v", err)
+		}
+	})
+}
+
+// feedWatchdog records that a valid message was received from the panel,
+// marking it available again if it had been lost. The caller must hold the lock.
+func (b *bridge) feedWatchdog() error {
+	if b.watchdog == nil {
+		return nil
+	}
+
+	b.watchdog.Reset(b.watchdogTimeout)
+
+	if !b.commLost {
+		return nil
+	}
+
+	logInfof("[alarm] Communication with the alarm restored")
+	b.commLost = false
+
+	return b.publishRetained(b.availabilityTopic(), b.availability())
+}
+
+// availability returns the payload for the availability topic. The caller
+// must hold the lock.
+func (b *bridge) availability() string {
+	if b.commLost {
+		return "offline"
+	}
+
+	return "online"
+}
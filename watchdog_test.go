@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stgraber/ad2mqtt/decoder"
+)
+
+func TestWatchdog(t *testing.T) {
+	b, client := newTestBridge(nil)
+	clock := &fakeClock{now: time.Now()}
+	b.clock = clock
+	b.startWatchdog(20 * time.Second)
+
+	topic := "homeassistant/alarm_control_panel/ad2mqtt/availability"
+
+	// Messages keep the panel available.
+	clock.Advance(15 * time.Second)
+	err := b.handleMessage(alarmdecoder.Message{Ready: true, UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(15 * time.Second)
+	if value, _ := client.get(topic); value == "offline" {
+		t.Fatalf("got availability %q before timeout", value)
+	}
+
+	// The panel goes quiet.
+	clock.Advance(10 * time.Second)
+	value, _ := client.get(topic)
+	if value != "offline" {
+		t.Fatalf("got availability %q after timeout; wanted %q", value, "offline")
+	}
+
+	// Messages resume.
+	err = b.handleMessage(alarmdecoder.Message{Ready: true, UnparsedMessage: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, _ = client.get(topic)
+	if value != "online" {
+		t.Fatalf("got availability %q after message; wanted %q", value, "online")
+	}
+}